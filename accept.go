@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// acceptLimiter is token bucket limiting new connections per second
+type acceptLimiter struct {
+	Rate  float64 // tokens per second
+	Burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newAcceptLimiter(rate float64, burst int) *acceptLimiter {
+	return &acceptLimiter{
+		Rate:   rate,
+		Burst:  float64(max(burst, 1)),
+		tokens: float64(max(burst, 1)),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until new connection is allowed,
+// excess connections are delayed in order of arrival
+func (l *acceptLimiter) Wait() {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.Burst, l.tokens+now.Sub(l.last).Seconds()*l.Rate)
+	l.last = now
+	l.tokens--
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.Rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(d)
+}
+
+// ModifyConnection delays accepting connection when rate exceeded,
+// called from listener accept loop so pending connections stay in backlog
+func (l *acceptLimiter) ModifyConnection(conn net.Conn) net.Conn {
+	l.Wait()
+	return conn
+}
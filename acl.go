@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	allowHosts     []string
+	denyHosts      []string
+	allowCIDRs     []*net.IPNet
+	denyCIDRs      []*net.IPNet
+	httpsOnlyHosts []string
+	connectPorts   []string // allowed CONNECT ports, empty for any
+)
+
+// hostAllowed reports whether destination host is allowed for request,
+// deny rules take precedence over allow rules,
+// authenticated user's and tenant's allow hosts further restrict destinations
+func hostAllowed(r *http.Request, host string) bool {
+	allowed, rule := hostRule(r, host)
+	audit(r, host, rule, allowed)
+	return allowed
+}
+
+// hostRule returns whether destination host is allowed and name of rule that decided
+func hostRule(r *http.Request, host string) (allowed bool, rule string) {
+	if matchHosts(denyHosts, host) {
+		return false, "deny-host"
+	}
+	if u := requestUser(r); u != nil && len(u.AllowHosts) > 0 && !matchHosts(u.AllowHosts, host) {
+		return false, "user-allow-hosts"
+	}
+	if t := requestTenant(r); t != nil && len(t.AllowHosts) > 0 && !matchHosts(t.AllowHosts, host) {
+		return false, "tenant-allow-hosts"
+	}
+	if matchHosts(allowHosts, host) {
+		return true, "allow-host"
+	}
+	if *defaultDeny && len(allowCIDRs) > 0 {
+		// decided by resolved ip in dialControl
+		return true, "allow-cidr"
+	}
+	return !*defaultDeny, "default"
+}
+
+// plainHTTPDenied reports whether plain http request to url is denied,
+// https only hosts must be reached with CONNECT or https
+func plainHTTPDenied(r *http.Request, u *url.URL) bool {
+	if u.Scheme == "http" && matchHosts(httpsOnlyHosts, u.Hostname()) {
+		audit(r, u.Hostname(), "https-only-host", false)
+		return true
+	}
+	return false
+}
+
+// parseConnectPorts parses allowed CONNECT ports
+func parseConnectPorts(list []string) error {
+	for _, p := range list {
+		n, err := strconv.Atoi(p)
+		if err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("invalid port %s", p)
+		}
+		connectPorts = append(connectPorts, strconv.Itoa(n))
+	}
+	if len(connectPorts) == 0 {
+		return fmt.Errorf("no port")
+	}
+	return nil
+}
+
+// connectPortAllowed reports whether port of CONNECT address is allowed
+func connectPortAllowed(addr string) bool {
+	if len(connectPorts) == 0 {
+		return true
+	}
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && slices.Contains(connectPorts, port)
+}
+
+// ipAllowed reports whether resolved ip of dialed host is allowed,
+// with default deny, ip must match allow cidrs unless host matched allow hosts
+func ipAllowed(host string, ip net.IP) bool {
+	if containsIP(denyCIDRs, ip) {
+		return false
+	}
+	if !*defaultDeny || len(allowCIDRs) == 0 {
+		return true
+	}
+	return containsIP(allowCIDRs, ip) || matchHosts(allowHosts, host)
+}
+
+// ipRulesConfigured reports whether any rule on resolved destination ip is configured,
+// these rules can be enforced only by egress dialing destination directly
+func ipRulesConfigured() bool {
+	return len(denyCIDRs) > 0 ||
+		(*defaultDeny && len(allowCIDRs) > 0) ||
+		(geoipDB != nil && (len(allowCountries) > 0 || len(denyCountries) > 0))
+}
+
+// ipRulesApply reports whether host is decided by rules on its resolved ip,
+// hosts matched allow hosts are decided by name
+func ipRulesApply(host string) bool {
+	return ipRulesConfigured() && !matchHosts(allowHosts, host)
+}
+
+// warnIPRulesThroughParent warns when resolved ip rules are configured with parent proxy,
+// hosts decided by these rules are denied through parent
+func warnIPRulesThroughParent() {
+	if !ipRulesConfigured() {
+		return
+	}
+	for _, eg := range egresses {
+		if eg.Proxied {
+			slog.Warn("ip rules can not be enforced through parent proxy, hosts not matched allow hosts are denied", "egress", eg.Name)
+		}
+	}
+	if u, _ := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "http", Host: "example.com"}}); u != nil {
+		slog.Warn("ip rules can not be enforced through HTTP_PROXY, hosts not matched allow hosts are denied", "proxy", u.Redacted())
+	}
+}
+
+type dialHostKey struct{}
+
+// aclDial passes dialed host to dialControl
+func aclDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			ctx = context.WithValue(ctx, dialHostKey{}, host)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// dialControl checks resolved destination ip before direct dial
+func dialControl(ctx context.Context, _, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	host, _, _ = strings.Cut(host, "%") // ipv6 zone
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	dialHost, _ := ctx.Value(dialHostKey{}).(string)
+	if !ipAllowed(dialHost, ip) {
+		return fmt.Errorf("%w: %s", errDestinationDenied, ip)
+	}
+
+	ok, err := countryAllowed(ip)
+	if err != nil {
+		return fmt.Errorf("geoip lookup %s: %w", ip, err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", errDestinationDenied, ip)
+	}
+	return nil
+}
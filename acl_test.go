@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParentEgressDeniedWithIPRules(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	denyCIDRs = []*net.IPNet{n}
+	t.Cleanup(func() { denyCIDRs, allowHosts = nil, nil })
+
+	for _, typ := range []string{"http", "socks5"} {
+		eg, err := newEgress(typ, egressConfig{Type: typ, Addr: "127.0.0.1:1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = eg.Dial(context.Background(), "tcp", "example.com:443")
+		if !errors.Is(err, errDestinationDenied) {
+			t.Errorf("%s: tunnel through parent: expected destination denied, got %v", typ, err)
+		}
+
+		r, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r = eg.withParent(r)
+		_, err = eg.Transport.RoundTrip(r)
+		if !errors.Is(err, errDestinationDenied) {
+			t.Errorf("%s: http through parent: expected destination denied, got %v", typ, err)
+		}
+
+		// allowed host is decided by name, not by resolved ip
+		allowHosts = []string{"example.com"}
+		_, err = eg.Dial(context.Background(), "tcp", "example.com:443")
+		if errors.Is(err, errDestinationDenied) {
+			t.Errorf("%s: tunnel through parent: expected allowed host not denied", typ)
+		}
+		r, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r = eg.withParent(r)
+		_, err = eg.Transport.RoundTrip(r)
+		if errors.Is(err, errDestinationDenied) {
+			t.Errorf("%s: http through parent: expected allowed host not denied", typ)
+		}
+		allowHosts = nil
+	}
+}
+
+func TestTrustConnectHostOnlyDenies(t *testing.T) {
+	*trustConnectHost = true
+	t.Cleanup(func() {
+		*trustConnectHost = false
+		*defaultDeny = false
+		allowHosts, denyHosts = nil, nil
+	})
+
+	cases := []struct {
+		name  string
+		setup func()
+	}{
+		{"allow rules use target ip", func() {
+			*defaultDeny = true
+			allowHosts, denyHosts = []string{"example.com"}, nil
+		}},
+		{"deny rules use intended host", func() {
+			*defaultDeny = false
+			allowHosts, denyHosts = nil, []string{"example.com"}
+		}},
+	}
+	for _, c := range cases {
+		c.setup()
+		r := httptest.NewRequest(http.MethodConnect, "192.0.2.1:443", nil)
+		r.Header.Set("X-Proxy-Connect-Host", "example.com")
+		w := httptest.NewRecorder()
+		handleTunnel(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", c.name, w.Code)
+		}
+	}
+}
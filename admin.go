@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/prom"
+)
+
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tunnels", adminListTunnels)
+	mux.HandleFunc("DELETE /tunnels/{id}", adminCloseTunnel)
+	mux.HandleFunc("GET /stats", adminStats)
+	mux.Handle("GET /metrics", prom.Handler())
+	mux.HandleFunc("GET /log-level", adminGetLogLevel)
+	mux.HandleFunc("PUT /log-level", adminSetLogLevel)
+	if *enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return adminAuth(mux)
+}
+
+// adminAuthConfigured reports whether credentials for admin server are configured,
+// users from config and ldap are not admins so they can not be used
+func adminAuthConfigured() bool {
+	return *adminToken != "" || *token != "" || (*authUser != "" && *authPass != "")
+}
+
+// adminAuth protects admin endpoints with admin token,
+// or proxy credentials using Authorization header when admin token is not set,
+// all requests are denied when no credentials configured
+func adminAuth(h http.Handler) http.Handler {
+	if *adminToken != "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+*adminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok := false
+		if *token != "" {
+			ok = subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+*token)) == 1
+		}
+		if !ok && *authUser != "" && *authPass != "" {
+			user, pass, _ := r.BasicAuth()
+			ok = subtle.ConstantTimeCompare([]byte(user), []byte(*authUser)) == 1 &&
+				subtle.ConstantTimeCompare([]byte(pass), []byte(*authPass)) == 1
+		}
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type tunnelInfo struct {
+	ID       string    `json:"id"`
+	ClientIP string    `json:"clientIp"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	BytesIn  int64     `json:"bytesIn"`
+	BytesOut int64     `json:"bytesOut"`
+}
+
+func adminListTunnels(w http.ResponseWriter, r *http.Request) {
+	list := make([]tunnelInfo, 0)
+	for _, t := range tunnels.List() {
+		list = append(list, tunnelInfo{
+			ID:       strconv.FormatUint(t.ID, 10),
+			ClientIP: t.ClientIP,
+			Target:   t.Target,
+			Start:    t.Start,
+			BytesIn:  t.BytesIn.Load(),
+			BytesOut: t.BytesOut.Load(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(list)
+}
+
+func adminCloseTunnel(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	t := tunnels.Get(id)
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	t.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	type connStats struct {
+		New        int64   `json:"new"`
+		Reused     int64   `json:"reused"`
+		ReuseRatio float64 `json:"reuseRatio"`
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		Requests            int64     `json:"requests"`
+		Tunnels             int64     `json:"tunnels"`
+		ActiveTunnels       int       `json:"activeTunnels"`
+		BytesIn             int64     `json:"bytesIn"`
+		BytesOut            int64     `json:"bytesOut"`
+		Errors              int64     `json:"errors"`
+		AuthFailures        int64     `json:"authFailures"`
+		UpstreamConnections connStats `json:"upstreamConnections"`
+	}{
+		Requests:      stats.Requests.Load(),
+		Tunnels:       stats.Tunnels.Load(),
+		ActiveTunnels: len(tunnels.List()),
+		BytesIn:       stats.BytesIn.Load(),
+		BytesOut:      stats.BytesOut.Load(),
+		Errors:        stats.Errors.Load(),
+		AuthFailures:  stats.AuthFailures.Load(),
+		UpstreamConnections: connStats{
+			New:        stats.UpstreamConnNew.Load(),
+			Reused:     stats.UpstreamConnReused.Load(),
+			ReuseRatio: stats.upstreamConnReuseRatio(),
+		},
+	})
+}
+
+func adminGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, logLevel.Level().String()+"\n")
+}
+
+// adminSetLogLevel sets log level from request body (ex. debug, info, warn, error)
+func adminSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, 64))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText(bytes.TrimSpace(b)); err != nil {
+		http.Error(w, "Invalid log level", http.StatusBadRequest)
+		return
+	}
+	prev := logLevel.Level()
+	setLogLevel(level)
+	slog.Warn("log level changed", "from", prev, "to", level, "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
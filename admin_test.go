@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	h := adminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// no credentials configured denies all
+	if adminAuthConfigured() {
+		t.Fatal("expected admin auth not configured")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/tunnels", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials configured, got %d", w.Code)
+	}
+
+	*adminToken = "secret"
+	t.Cleanup(func() { *adminToken = "" })
+	h = adminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/tunnels", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/tunnels", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 with token, got %d", w.Code)
+	}
+}
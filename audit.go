@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// auditLog logs access control decisions, nil if -audit-log is not set
+var auditLog *slog.Logger
+
+// setupAuditLog opens -audit-log destination
+func setupAuditLog() error {
+	if *auditLogFile == "" {
+		return nil
+	}
+
+	var w io.Writer
+	switch *auditLogFile {
+	case "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		f, err := os.OpenFile(*auditLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	auditLog = slog.New(slog.NewJSONHandler(w, nil))
+	return nil
+}
+
+// audit logs access control decision of request to target,
+// rule is the rule that decided, or default when no rule matched
+func audit(r *http.Request, target, rule string, allowed bool) {
+	if auditLog == nil {
+		return
+	}
+	decision := "deny"
+	if allowed {
+		decision = "allow"
+	}
+	auditLog.Info("acl",
+		"user", logIdentity(r),
+		"client_ip", clientIP(r),
+		"method", r.Method,
+		"target", target,
+		"rule", rule,
+		"decision", decision,
+	)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/authn"
+)
+
+type user struct {
+	Name       string
+	Password   string
+	Egress     *egress  // nil to use routing table
+	AllowHosts []string // empty to allow all hosts
+	Exits      []string // exits user can select with exit header
+}
+
+var users = make(map[string]*user)
+
+// setupUsers adds users from config
+func setupUsers(cfg *config) error {
+	for _, c := range cfg.Users {
+		if c.Username == "" {
+			return fmt.Errorf("user: missing username")
+		}
+		u := user{
+			Name:       c.Username,
+			Password:   c.Password,
+			AllowHosts: c.AllowHosts,
+			Exits:      c.Exits,
+		}
+		if c.Egress != "" {
+			u.Egress = egresses[c.Egress]
+			if u.Egress == nil {
+				return fmt.Errorf("user %s: egress %s not found", c.Username, c.Egress)
+			}
+		}
+		users[u.Name] = &u
+	}
+	return nil
+}
+
+// Authenticator authenticates proxy requests
+type Authenticator interface {
+	// Authenticate returns identity of the request,
+	// or error if request can not be authenticated
+	Authenticate(r *http.Request) (identity string, err error)
+
+	// Schemes returns schemes to challenge client with
+	Schemes() []string
+}
+
+// tokenAuthenticator compares Proxy-Authorization header with static token,
+// with -accept-authorization-header Bearer token in Authorization header is also accepted
+type tokenAuthenticator struct {
+	Token string
+}
+
+func (a tokenAuthenticator) Authenticate(r *http.Request) (string, error) {
+	// TODO: change to Proxy-Authorization: Bearer but breaking change
+	reqToken := r.Header.Get("Proxy-Authorization")
+	if reqToken == "" && *acceptAuthorizationHeader {
+		return a.authenticateAuthorization(r)
+	}
+	if reqToken == "" {
+		return "", authn.ErrMissingAuthorization
+	}
+	if subtle.ConstantTimeCompare([]byte(reqToken), []byte(a.Token)) != 1 {
+		return "", authn.ErrInvalidCredentials
+	}
+	return "token", nil
+}
+
+// authenticateAuthorization checks Bearer token in Authorization header,
+// header is removed only when it carries the token,
+// other Authorization values are left for upstream
+func (a tokenAuthenticator) authenticateAuthorization(r *http.Request) (string, error) {
+	reqToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(reqToken), []byte(a.Token)) != 1 {
+		return "", authn.ErrMissingAuthorization
+	}
+	r.Header.Del("Authorization")
+	return "token", nil
+}
+
+func (tokenAuthenticator) Schemes() []string {
+	return []string{"Bearer"}
+}
+
+// basicAuthenticator authenticates Basic credentials with users
+type basicAuthenticator struct {
+	Users map[string]*user
+}
+
+func (a basicAuthenticator) Authenticate(r *http.Request) (string, error) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", authn.ErrMissingAuthorization
+	}
+	username, password, ok := parseBasicAuth(auth)
+	if !ok {
+		return "", authn.ErrInvalidCredentials
+	}
+	u := a.Users[username]
+	if u == nil || subtle.ConstantTimeCompare([]byte(password), []byte(u.Password)) != 1 {
+		return "", authn.ErrInvalidCredentials
+	}
+	return u.Name, nil
+}
+
+func (basicAuthenticator) Schemes() []string {
+	return []string{"Basic"}
+}
+
+// multiAuthenticator tries authenticators in order,
+// the first one that succeeds wins
+type multiAuthenticator []Authenticator
+
+func (m multiAuthenticator) Authenticate(r *http.Request) (string, error) {
+	err := authn.ErrMissingAuthorization
+	for _, a := range m {
+		var id string
+		id, err = a.Authenticate(r)
+		if err == nil {
+			return id, nil
+		}
+	}
+	return "", err
+}
+
+func (m multiAuthenticator) Schemes() []string {
+	var ss []string
+	for _, a := range m {
+		for _, s := range a.Schemes() {
+			if !slices.Contains(ss, s) {
+				ss = append(ss, s)
+			}
+		}
+	}
+	return ss
+}
+
+// authBackendError reports credentials could not be verified
+// because authentication backend is unavailable
+type authBackendError struct {
+	Identity string // unverified identity from credentials
+	Err      error
+}
+
+func (err *authBackendError) Error() string {
+	return "auth backend unavailable: " + err.Err.Error()
+}
+
+func (err *authBackendError) Unwrap() error {
+	return err.Err
+}
+
+type (
+	identityKey           struct{}
+	unverifiedIdentityKey struct{}
+)
+
+// authenticate returns middleware that authenticates requests with a,
+// authenticated identity is stored in request context,
+// when auth backend is unavailable request is denied or admitted by -auth-fail-mode
+func authenticate(a Authenticator) parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, err := a.Authenticate(r)
+			r.Header.Del("Proxy-Authorization")
+			var backendErr *authBackendError
+			if errors.As(err, &backendErr) {
+				if *authFailMode != "open" {
+					stats.AuthFailures.Add(1)
+					proxyError(w, r, "Authentication Unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				slog.Warn("auth backend unavailable, fail open admits request",
+					"user", backendErr.Identity,
+					"client_ip", clientIP(r),
+					"addr", r.RequestURI,
+					"error", backendErr.Err,
+				)
+				// identity is not verified, admit as anonymous without user privileges
+				h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), unverifiedIdentityKey{}, backendErr.Identity)))
+				return
+			}
+			if err != nil {
+				stats.AuthFailures.Add(1)
+				unauthorized(w, r, a.Schemes(), err)
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+		})
+	})
+}
+
+// identity returns authenticated identity from request
+func identity(r *http.Request) string {
+	name, _ := r.Context().Value(identityKey{}).(string)
+	return name
+}
+
+// logIdentity returns identity to log,
+// identity admitted by -auth-fail-mode open is marked unverified
+func logIdentity(r *http.Request) string {
+	if name, ok := r.Context().Value(unverifiedIdentityKey{}).(string); ok {
+		return "unverified:" + name
+	}
+	return identity(r)
+}
+
+// debugIdentity returns identity to send in -debug-identity-header,
+// empty if disabled or request is not authenticated
+func debugIdentity(r *http.Request) string {
+	if *debugIdentityHeader == "" {
+		return ""
+	}
+	return identity(r)
+}
+
+// requestUser returns authenticated user of request, nil if not authenticated
+func requestUser(r *http.Request) *user {
+	name := identity(r)
+	if name == "" {
+		return nil
+	}
+	if u := users[name]; u != nil {
+		return u
+	}
+	if ldapAuth != nil {
+		return ldapAuth.user(name)
+	}
+	return nil
+}
+
+func parseBasicAuth(auth string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return
+	}
+	username, password, ok = strings.Cut(string(b), ":")
+	return
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type backendDownAuthenticator struct{}
+
+func (backendDownAuthenticator) Authenticate(r *http.Request) (string, error) {
+	return "", &authBackendError{Identity: "alice", Err: errors.New("ldap down")}
+}
+
+func (backendDownAuthenticator) Schemes() []string { return []string{"Basic"} }
+
+func TestAuthFailOpenAdmitsAnonymous(t *testing.T) {
+	*authFailMode = "open"
+	users["alice"] = &user{Name: "alice", Exits: []string{"office"}}
+	t.Cleanup(func() {
+		*authFailMode = "closed"
+		delete(users, "alice")
+	})
+
+	called := false
+	h := authenticate(backendDownAuthenticator{}).ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if identity(r) != "" {
+			t.Errorf("expected no verified identity, got %s", identity(r))
+		}
+		if requestUser(r) != nil {
+			t.Error("expected unverified identity to have no user privileges")
+		}
+		if logIdentity(r) != "unverified:alice" {
+			t.Errorf("expected unverified identity in log, got %s", logIdentity(r))
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if !called {
+		t.Fatal("expected request admitted")
+	}
+}
+
+func TestUnauthorizedChallenge(t *testing.T) {
+	a := multiAuthenticator{
+		tokenAuthenticator{Token: "secret"},
+		basicAuthenticator{Users: map[string]*user{"alice": {Name: "alice", Password: "pw"}}},
+	}
+	h := authenticate(a).ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("missing credentials: expected 407, got %d", w.Code)
+	}
+	got := w.Header().Values("Proxy-Authenticate")
+	if len(got) != 2 || got[0] != "Bearer" || got[1] != `Basic realm="httpproxy"` {
+		t.Errorf("missing credentials: expected challenge per scheme, got %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("Proxy-Authorization", "Basic YWxpY2U6d3Jvbmc=")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("invalid credentials: expected 407, got %d", w.Code)
+	}
+	if v := w.Header().Values("Proxy-Authenticate"); len(v) != 0 {
+		t.Errorf("invalid credentials: expected no challenge, got %q", v)
+	}
+	if !strings.Contains(w.Body.String(), "Invalid Credentials") {
+		t.Errorf("invalid credentials: unexpected body %q", w.Body.String())
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+)
+
+// bindEgresses are direct egresses dialing from each -bind-ip,
+// requests using direct egress are pinned to one of them by -bind-ip-key
+var bindEgresses []*egress
+
+// setupBindIPs creates direct egress for each bind ip
+func setupBindIPs(list []string) error {
+	switch *bindIPKey {
+	case "ip", "user":
+	default:
+		return fmt.Errorf("invalid bind ip key %s", *bindIPKey)
+	}
+
+	for _, ip := range list {
+		eg, err := newEgress("direct-"+ip, egressConfig{Type: "direct", Bind: ip})
+		if err != nil {
+			return err
+		}
+		bindEgresses = append(bindEgresses, eg)
+		egresses[eg.Name] = eg
+	}
+	return nil
+}
+
+// stickyEgress returns bind egress for request using rendezvous hashing,
+// the same key always selects the same bind ip,
+// and only keys of removed bind ip move when list changes
+func stickyEgress(r *http.Request) *egress {
+	key := clientIP(r)
+	if *bindIPKey == "user" {
+		if id := identity(r); id != "" {
+			key = id
+		}
+	}
+
+	var (
+		best      *egress
+		bestScore uint64
+	)
+	for _, eg := range bindEgresses {
+		h := fnv.New64a()
+		io.WriteString(h, key)
+		h.Write([]byte{0})
+		io.WriteString(h, eg.Name)
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = eg, score
+		}
+	}
+	return best
+}
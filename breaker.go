@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker short-circuits requests to hosts that keep failing
+type circuitBreaker struct {
+	mu sync.Mutex
+	m  map[string]*hostBreaker
+}
+
+type hostBreaker struct {
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+	probing      bool
+}
+
+var breaker = circuitBreaker{
+	m: make(map[string]*hostBreaker),
+}
+
+func (b *circuitBreaker) enabled() bool {
+	return *breakerThreshold > 0
+}
+
+// Allow reports whether request to host can be made,
+// after cooldown only one probe request is allowed until it reports result
+func (b *circuitBreaker) Allow(host string) bool {
+	if !b.enabled() {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hb := b.m[host]
+	if hb == nil || hb.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(hb.openUntil) || hb.probing {
+		breakerRejects.Inc()
+		return false
+	}
+	hb.probing = true
+	return true
+}
+
+// Success reports success request to host, closes the breaker
+func (b *circuitBreaker) Success(host string) {
+	if !b.enabled() {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hb := b.m[host]
+	if hb == nil {
+		return
+	}
+	if !hb.openUntil.IsZero() {
+		breakerOpenHosts.Dec()
+	}
+	delete(b.m, host)
+}
+
+// Done reports request to host finished without telling whether host is healthy,
+// ex. denied by policy, releases probe so next request can probe again
+func (b *circuitBreaker) Done(host string) {
+	if !b.enabled() {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if hb := b.m[host]; hb != nil {
+		hb.probing = false
+	}
+}
+
+// Failure reports failed request to host
+func (b *circuitBreaker) Failure(host string) {
+	if !b.enabled() {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	hb := b.m[host]
+	if hb == nil {
+		hb = &hostBreaker{}
+		b.m[host] = hb
+	}
+
+	// failed probe, open again
+	if hb.probing {
+		hb.probing = false
+		hb.openUntil = now.Add(*breakerCooldown)
+		return
+	}
+	if !hb.openUntil.IsZero() {
+		return
+	}
+
+	if now.Sub(hb.firstFailure) > *breakerWindow {
+		hb.failures = 0
+		hb.firstFailure = now
+	}
+	hb.failures++
+	if hb.failures >= *breakerThreshold {
+		hb.openUntil = now.Add(*breakerCooldown)
+		breakerOpenHosts.Inc()
+		breakerTrips.Inc()
+	}
+}
+
+func (b *circuitBreaker) cleanupLoop() {
+	for {
+		time.Sleep(*breakerWindow)
+		b.cleanup()
+	}
+}
+
+// cleanup removes closed breakers that failures are out of window
+func (b *circuitBreaker) cleanup() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for host, hb := range b.m {
+		if hb.openUntil.IsZero() && now.Sub(hb.firstFailure) > *breakerWindow {
+			delete(b.m, host)
+		}
+	}
+}
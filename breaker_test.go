@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreakerDoneReleasesProbe(t *testing.T) {
+	threshold, cooldown := *breakerThreshold, *breakerCooldown
+	*breakerThreshold, *breakerCooldown = 1, time.Millisecond
+	t.Cleanup(func() { *breakerThreshold, *breakerCooldown = threshold, cooldown })
+
+	b := circuitBreaker{m: make(map[string]*hostBreaker)}
+	b.Failure("example.com")
+	if b.Allow("example.com") {
+		t.Fatal("expected breaker open")
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	if !b.Allow("example.com") {
+		t.Fatal("expected probe allowed after cooldown")
+	}
+	if b.Allow("example.com") {
+		t.Fatal("expected only one probe")
+	}
+
+	// probe denied by policy does not tell host health
+	b.Done("example.com")
+	if !b.Allow("example.com") {
+		t.Fatal("expected probe released by done")
+	}
+}
+
+func TestBreakerIgnoresCancelledRequests(t *testing.T) {
+	threshold := *breakerThreshold
+	*breakerThreshold = 1
+	t.Cleanup(func() {
+		*breakerThreshold = threshold
+		breaker.mu.Lock()
+		delete(breaker.m, "127.0.0.1")
+		breaker.mu.Unlock()
+	})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for range 3 {
+		r, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL, nil)
+		if _, err := roundTrip(r); err == nil {
+			t.Fatal("expected cancelled request error")
+		}
+	}
+	if !breaker.Allow("127.0.0.1") {
+		t.Error("expected breaker closed after cancelled requests")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the proxy config file
+//
+// Example:
+//
+//	egress:
+//	  filtered:
+//	    type: socks5
+//	    addr: 10.0.0.1:1080
+//	  office:
+//	    type: direct
+//	    bind: 192.168.1.10
+//	routes:
+//	- hosts: ["*.example.com"]
+//	  egress: filtered
+//	defaultRoute: office
+//	users:
+//	- username: alice
+//	  password: secret
+//	  egress: filtered
+//	  allowHosts: ["*.example.com"]
+//	ldapGroups:
+//	- group: cn=proxy-users,ou=groups,dc=example,dc=com
+//	  egress: office
+//	tenants:
+//	  acme:
+//	    egress: filtered
+//	    maxInflight: 100
+//	    users: [alice]
+//	  shared:
+//	    maxInflight: 10
+//	defaultTenant: shared
+//	exits:
+//	  eu: filtered
+//	  office: office
+type config struct {
+	Egress        map[string]egressConfig `yaml:"egress"`
+	Routes        []routeConfig           `yaml:"routes"`
+	DefaultRoute  string                  `yaml:"defaultRoute"`
+	Users         []userConfig            `yaml:"users"`
+	LDAPGroups    []ldapGroupConfig       `yaml:"ldapGroups"`
+	Tenants       map[string]tenantConfig `yaml:"tenants"`
+	DefaultTenant string                  `yaml:"defaultTenant"`
+	Exits         map[string]string       `yaml:"exits"` // exit name to egress name
+}
+
+type egressConfig struct {
+	Type     string `yaml:"type"` // direct, socks5, http
+	Addr     string `yaml:"addr"` // proxy address for socks5 and http
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Bind     string `yaml:"bind"` // local ip to dial from
+}
+
+type routeConfig struct {
+	Hosts  []string `yaml:"hosts"`
+	Egress string   `yaml:"egress"`
+}
+
+// loadConfig loads config file, or all *.yaml files in lexical order when filename is directory,
+// later files override earlier files
+func loadConfig(filename string) (*config, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return loadConfigFile(filename)
+	}
+
+	files, err := filepath.Glob(filepath.Join(filename, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config file in %s", filename)
+	}
+	var cfg config
+	for _, f := range files {
+		c, err := loadConfigFile(f)
+		if err != nil {
+			return nil, err
+		}
+		cfg.merge(c)
+	}
+	return &cfg, nil
+}
+
+func loadConfigFile(filename string) (*config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	err = yaml.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s; %w", filename, err)
+	}
+	slog.Info("config loaded", "file", filename)
+	return &cfg, nil
+}
+
+// merge overrides config with fields set in x,
+// egresses, tenants and exits are merged by name, lists are replaced
+func (cfg *config) merge(x *config) {
+	for name, eg := range x.Egress {
+		if cfg.Egress == nil {
+			cfg.Egress = make(map[string]egressConfig)
+		}
+		cfg.Egress[name] = eg
+	}
+	if x.Routes != nil {
+		cfg.Routes = x.Routes
+	}
+	if x.DefaultRoute != "" {
+		cfg.DefaultRoute = x.DefaultRoute
+	}
+	if x.Users != nil {
+		cfg.Users = x.Users
+	}
+	if x.LDAPGroups != nil {
+		cfg.LDAPGroups = x.LDAPGroups
+	}
+	for name, t := range x.Tenants {
+		if cfg.Tenants == nil {
+			cfg.Tenants = make(map[string]tenantConfig)
+		}
+		cfg.Tenants[name] = t
+	}
+	if x.DefaultTenant != "" {
+		cfg.DefaultTenant = x.DefaultTenant
+	}
+	for name, eg := range x.Exits {
+		if cfg.Exits == nil {
+			cfg.Exits = make(map[string]string)
+		}
+		cfg.Exits[name] = eg
+	}
+}
+
+type userConfig struct {
+	Username   string   `yaml:"username"`
+	Password   string   `yaml:"password"`
+	Egress     string   `yaml:"egress"`     // empty to use routing table
+	AllowHosts []string `yaml:"allowHosts"` // empty to allow all hosts
+	Exits      []string `yaml:"exits"`      // exits user can select with exit header
+}
+
+// ldapGroupConfig maps members of LDAP group to user settings
+type ldapGroupConfig struct {
+	Group      string   `yaml:"group"` // group dn
+	Egress     string   `yaml:"egress"`
+	AllowHosts []string `yaml:"allowHosts"`
+	Exits      []string `yaml:"exits"`
+}
+
+// tenantConfig is egress and limits profile of tenant
+type tenantConfig struct {
+	Egress      string   `yaml:"egress"`      // empty to use routing table
+	AllowHosts  []string `yaml:"allowHosts"`  // empty to allow all hosts
+	MaxInflight int      `yaml:"maxInflight"` // 0 for unlimited
+	Users       []string `yaml:"users"`       // identities allowed to select tenant when auth is configured
+}
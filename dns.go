@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// dnsCache caches destination host lookups,
+// not found results are cached separately when -dns-negative-ttl is set
+type dnsCache struct {
+	mu sync.Mutex
+	m  map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+var resolver = dnsCache{m: make(map[string]*dnsEntry)}
+
+func (c *dnsCache) enabled() bool {
+	return *dnsCacheTTL > 0 || *dnsNegativeTTL > 0 || *dnsRate > 0
+}
+
+// LookupHost returns addresses of host
+func (c *dnsCache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return []string{host}, nil
+	}
+
+	c.mu.Lock()
+	e := c.m[host]
+	c.mu.Unlock()
+	if e != nil && time.Now().Before(e.expires) {
+		return e.addrs, e.err
+	}
+
+	if err := dnsLimit.Wait(ctx); err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	ttl := *dnsCacheTTL
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		ttl = *dnsNegativeTTL
+	}
+	if ttl > 0 {
+		c.mu.Lock()
+		c.m[host] = &dnsEntry{
+			addrs:   addrs,
+			err:     err,
+			expires: time.Now().Add(ttl),
+		}
+		c.mu.Unlock()
+	}
+	return addrs, err
+}
+
+var errDNSRateLimited = errors.New("dns rate limited")
+
+// dnsLimiter spaces dns lookups by -dns-rate,
+// at most -dns-queue lookups wait for their turn
+type dnsLimiter struct {
+	mu      sync.Mutex
+	next    time.Time // time of next allowed lookup
+	waiting int
+}
+
+var dnsLimit dnsLimiter
+
+// Wait blocks until lookup is allowed,
+// returns errDNSRateLimited if queue is full
+func (l *dnsLimiter) Wait(ctx context.Context) error {
+	if *dnsRate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	if d > 0 && l.waiting >= *dnsQueue {
+		l.mu.Unlock()
+		return errDNSRateLimited
+	}
+	l.next = l.next.Add(time.Second / time.Duration(*dnsRate))
+	if d > 0 {
+		l.waiting++
+	}
+	l.mu.Unlock()
+
+	if d <= 0 {
+		return nil
+	}
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *dnsCache) cleanupLoop() {
+	for {
+		time.Sleep(time.Minute)
+		c.cleanup()
+	}
+}
+
+// cleanup removes expired entries
+func (c *dnsCache) cleanup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for host, e := range c.m {
+		if now.After(e.expires) {
+			delete(c.m, host)
+		}
+	}
+}
+
+// cachedDial returns dial function that resolves destination with dns cache,
+// addresses are tried in order until one connects
+func cachedDial(d *net.Dialer) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !resolver.enabled() {
+			return d.DialContext(ctx, network, addr)
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+
+		var conn net.Conn
+		for _, ip := range addrs {
+			conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
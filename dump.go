@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// dumpTunnelsLoop dumps active tunnels when receives dump signal
+func dumpTunnelsLoop() {
+	c := notifyDumpSignal()
+	if c == nil {
+		return
+	}
+	for range c {
+		err := dumpTunnelsTo(*tunnelDumpFile)
+		if err != nil {
+			slog.Error("dump tunnels error", "error", err)
+		}
+	}
+}
+
+// dumpTunnelsTo writes active tunnels snapshot to file, or stderr if file is empty
+func dumpTunnelsTo(file string) error {
+	if file == "" {
+		return dumpTunnels(os.Stderr)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	err = dumpTunnels(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// dumpTunnels writes active tunnels, one per line
+func dumpTunnels(w io.Writer) error {
+	now := time.Now()
+	list := tunnels.List()
+	_, err := fmt.Fprintf(w, "# active tunnels: %d at %s\n", len(list), now.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	for _, t := range list {
+		_, err = fmt.Fprintf(w, "id=%d client=%s target=%s age=%s bytes_in=%d bytes_out=%d\n",
+			t.ID, t.ClientIP, t.Target, now.Sub(t.Start).Truncate(time.Second), t.BytesIn.Load(), t.BytesOut.Load())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+// notifyDumpSignal returns nil, windows does not have SIGUSR1
+func notifyDumpSignal() <-chan os.Signal {
+	return nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// egress is an outgoing path to destinations
+type egress struct {
+	Name      string
+	Dial      dialFunc // dials tunnel connection
+	Transport *http.Transport
+	Parent    func(*http.Request) (*url.URL, error) // selects parent proxy of http request, nil if none
+	Proxied   bool                                  // reaches destinations through parent proxy
+
+	mu             sync.Mutex
+	idleTransports map[time.Duration]*http.Transport // clones of Transport by -host-idle-timeout
+}
+
+var dialer = net.Dialer{
+	Timeout:        10 * time.Second,
+	KeepAlive:      15 * time.Second,
+	ControlContext: dialControl,
+}
+
+var httpTransport = newTransport(aclDial(cachedDial(&net.Dialer{
+	Timeout:        5 * time.Second,
+	KeepAlive:      10 * time.Second,
+	ControlContext: dialControl,
+})))
+
+var directEgress = &egress{
+	Name:      "direct",
+	Dial:      aclDial(cachedDial(&dialer)),
+	Transport: httpTransport,
+	Parent:    http.ProxyFromEnvironment,
+}
+
+func init() {
+	httpTransport.Proxy = directEgress.proxy
+}
+
+func newTransport(dial dialFunc) *http.Transport {
+	return &http.Transport{
+		DialContext:         overrideDial(dial),
+		MaxIdleConnsPerHost: 1000,
+		IdleConnTimeout:     1 * time.Minute,
+		DisableCompression:  true,
+	}
+}
+
+// pruneIdleLoop closes idle upstream connections of all egresses every interval
+func pruneIdleLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for _, eg := range egresses {
+			eg.closeIdleConnections()
+		}
+	}
+}
+
+// idleTimeoutOverride overrides idle timeout of upstream connections to destination hosts
+type idleTimeoutOverride struct {
+	Host    string // host pattern
+	Timeout time.Duration
+}
+
+var hostIdleTimeouts []idleTimeoutOverride
+
+// parseHostIdleTimeouts parses host=duration entries into host idle timeouts
+func parseHostIdleTimeouts(list []string) error {
+	for _, s := range list {
+		host, v, ok := strings.Cut(s, "=")
+		if !ok || host == "" {
+			return fmt.Errorf("invalid host idle timeout %s", s)
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid host idle timeout %s", s)
+		}
+		hostIdleTimeouts = append(hostIdleTimeouts, idleTimeoutOverride{Host: host, Timeout: d})
+	}
+	return nil
+}
+
+// transport returns transport to send http request to host,
+// hosts with idle timeout override use clone of egress transport,
+// since idle timeout can only be set per transport
+func (eg *egress) transport(host string) *http.Transport {
+	for _, o := range hostIdleTimeouts {
+		if !matchHost(o.Host, host) {
+			continue
+		}
+		if o.Timeout == eg.Transport.IdleConnTimeout {
+			break
+		}
+
+		eg.mu.Lock()
+		defer eg.mu.Unlock()
+		t := eg.idleTransports[o.Timeout]
+		if t == nil {
+			t = eg.Transport.Clone()
+			t.IdleConnTimeout = o.Timeout
+			if eg.idleTransports == nil {
+				eg.idleTransports = make(map[time.Duration]*http.Transport)
+			}
+			eg.idleTransports[o.Timeout] = t
+		}
+		return t
+	}
+	return eg.Transport
+}
+
+// closeIdleConnections closes idle upstream connections of all egress transports
+func (eg *egress) closeIdleConnections() {
+	eg.Transport.CloseIdleConnections()
+
+	eg.mu.Lock()
+	defer eg.mu.Unlock()
+	for _, t := range eg.idleTransports {
+		t.CloseIdleConnections()
+	}
+}
+
+func newEgress(name string, cfg egressConfig) (*egress, error) {
+	d := dialer
+	d.ControlContext = nil // dial to proxy
+	if cfg.Bind != "" {
+		ip := net.ParseIP(cfg.Bind)
+		if ip == nil {
+			return nil, fmt.Errorf("egress %s: invalid bind ip %s", name, cfg.Bind)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	eg := egress{Name: name}
+	switch cfg.Type {
+	case "", "direct":
+		d.ControlContext = dialControl
+		eg.Dial = aclDial(cachedDial(&d))
+		eg.Transport = newTransport(eg.Dial)
+	case "socks5":
+		var auth *netproxy.Auth
+		if cfg.Username != "" {
+			auth = &netproxy.Auth{User: cfg.Username, Password: cfg.Password}
+		}
+		sd, err := netproxy.SOCKS5("tcp", cfg.Addr, auth, &d)
+		if err != nil {
+			return nil, fmt.Errorf("egress %s: %w", name, err)
+		}
+		eg.Dial = parentDial(sd.(netproxy.ContextDialer).DialContext)
+		eg.Transport = newTransport(eg.Dial)
+		eg.Proxied = true
+	case "http":
+		if cfg.Addr == "" {
+			return nil, fmt.Errorf("egress %s: missing addr", name)
+		}
+		u := &url.URL{Scheme: "http", Host: cfg.Addr}
+		if cfg.Username != "" {
+			u.User = url.UserPassword(cfg.Username, cfg.Password)
+		}
+		pd := &httpProxyDialer{
+			Addr:    cfg.Addr,
+			Forward: &d,
+		}
+		if cfg.Username != "" {
+			pd.Auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.Username+":"+cfg.Password))
+		}
+		eg.Dial = parentDial(pd.DialContext)
+		eg.Transport = newTransport(d.DialContext)
+		eg.Parent = http.ProxyURL(u)
+		eg.Transport.Proxy = eg.proxy
+		eg.Proxied = true
+	default:
+		return nil, fmt.Errorf("egress %s: unknown type %s", name, cfg.Type)
+	}
+	return &eg, nil
+}
+
+type parentKey struct{}
+
+// parentChoice is parent proxy selected for http request
+type parentChoice struct {
+	URL *url.URL
+	Err error
+}
+
+// withParent selects parent proxy of http request once and stores it in request context,
+// selection may advance round robin state so it must not be repeated for inspection
+func (eg *egress) withParent(r *http.Request) *http.Request {
+	if eg.Parent == nil {
+		return r
+	}
+	u, err := eg.selectParent(r)
+	return r.WithContext(context.WithValue(r.Context(), parentKey{}, &parentChoice{URL: u, Err: err}))
+}
+
+// selectParent selects parent proxy of http request,
+// request through parent is denied when host is decided by resolved ip rules
+// since parent resolves destination and dialControl can not check it
+func (eg *egress) selectParent(r *http.Request) (*url.URL, error) {
+	u, err := eg.Parent(r)
+	if err == nil && u != nil && ipRulesApply(r.URL.Hostname()) {
+		return nil, fmt.Errorf("%w: %s through parent proxy", errDestinationDenied, r.URL.Host)
+	}
+	return u, err
+}
+
+// proxy is transport proxy function, returns parent selected by withParent,
+// or selects parent for requests sent without withParent
+func (eg *egress) proxy(r *http.Request) (*url.URL, error) {
+	if c, ok := r.Context().Value(parentKey{}).(*parentChoice); ok {
+		return c.URL, c.Err
+	}
+	if eg.Parent == nil {
+		return nil, nil
+	}
+	return eg.selectParent(r)
+}
+
+// parentDial denies tunnel through parent proxy when host is decided by resolved ip rules,
+// since parent resolves destination and dialControl can not check it
+func parentDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		if ipRulesApply(host) {
+			return nil, fmt.Errorf("%w: %s through parent proxy", errDestinationDenied, addr)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// viaParent reports whether http request is forwarded through parent proxy selected by withParent
+func (eg *egress) viaParent(r *http.Request) bool {
+	c, _ := r.Context().Value(parentKey{}).(*parentChoice)
+	return c != nil && c.Err == nil && c.URL != nil
+}
+
+// withForwardedFor returns copy of request with client ip appended to X-Forwarded-For
+func withForwardedFor(r *http.Request) *http.Request {
+	r = r.Clone(r.Context())
+	ip := clientIP(r)
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	r.Header.Set("X-Forwarded-For", ip)
+	return r
+}
+
+// parentProxyError is non-200 response from parent proxy to CONNECT
+type parentProxyError struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+	AuthSent   bool // request had Proxy-Authorization
+}
+
+func (err *parentProxyError) Error() string {
+	return "parent proxy: " + err.Status
+}
+
+// clientStatus returns status code to send to client,
+// parent error status is passed through except statuses client can not act on,
+// such as parent rejecting our credentials
+func (err *parentProxyError) clientStatus() int {
+	switch {
+	case err.passAuthChallenge():
+		return http.StatusProxyAuthRequired
+	case err.StatusCode < 400,
+		err.StatusCode == http.StatusUnauthorized,
+		err.StatusCode == http.StatusProxyAuthRequired:
+		return http.StatusBadGateway
+	}
+	return err.StatusCode
+}
+
+// passAuthChallenge reports whether parent 407 challenge should be sent to client,
+// only when egress has no credentials for parent
+func (err *parentProxyError) passAuthChallenge() bool {
+	return err.StatusCode == http.StatusProxyAuthRequired &&
+		!err.AuthSent &&
+		err.Header.Get("Proxy-Authenticate") != ""
+}
+
+// httpProxyDialer dials through parent http proxy using CONNECT
+type httpProxyDialer struct {
+	Addr    string
+	Auth    string // Proxy-Authorization value
+	Forward *net.Dialer
+}
+
+// DialContext dials addr through parent proxy,
+// when parent rejects credentials with 407 it retries once on new connection
+// in case parent requires fresh connection for authentication
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.connect(ctx, network, addr)
+	var parentErr *parentProxyError
+	if d.Auth != "" && errors.As(err, &parentErr) && parentErr.StatusCode == http.StatusProxyAuthRequired {
+		conn, err = d.connect(ctx, network, addr)
+	}
+	return conn, err
+}
+
+func (d *httpProxyDialer) connect(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.Forward.DialContext(ctx, network, d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(d.Forward.Timeout))
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.Auth != "" {
+		req.Header.Set("Proxy-Authorization", d.Auth)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &parentProxyError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Header:     resp.Header,
+			AuthSent:   d.Auth != "",
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is net.Conn that reads remaining bytes from buffer first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
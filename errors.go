@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// proxyError replies proxy generated error to client
+func proxyError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	stats.Errors.Add(1)
+	if v := debugIdentity(r); v != "" {
+		w.Header().Set(*debugIdentityHeader, v)
+	}
+
+	if *errorFormat != "json" {
+		http.Error(w, msg, code)
+		return
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+		Host  string `json:"host,omitempty"`
+	}{msg, code, targetHost(r)})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/moonrhythm/parapet"
+)
+
+// exits maps exit name, which users select with -exit-header, to egress
+var exits = make(map[string]*egress)
+
+// setupExits adds exits from config,
+// must run after bind ip egresses are added
+func setupExits(cfg *config) error {
+	for name, egName := range cfg.Exits {
+		eg := egresses[egName]
+		if eg == nil {
+			return fmt.Errorf("exit %s: egress %s not found", name, egName)
+		}
+		exits[name] = eg
+	}
+	return nil
+}
+
+type exitKey struct{}
+
+// selectExit returns middleware that selects egress from exit header,
+// exit must be permitted for authenticated user, exit header is always removed from request
+func selectExit() parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := r.Header.Get(*exitHeader)
+			r.Header.Del(*exitHeader)
+			if name == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			eg := exits[name]
+			u := requestUser(r)
+			if eg == nil || u == nil || !slices.Contains(u.Exits, name) {
+				audit(r, name, "exit", false)
+				proxyError(w, r, "Exit not allowed", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exitKey{}, eg)))
+		})
+	})
+}
+
+// requestExit returns egress selected by exit header, nil if none
+func requestExit(r *http.Request) *egress {
+	eg, _ := r.Context().Value(exitKey{}).(*egress)
+	return eg
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var errFastOpenNotSupported = errors.New("tcp fast open not supported")
+
+// fastOpenQueueLen is maximum pending TFO connections not yet completed 3-way handshake
+const fastOpenQueueLen = 256
+
+// fastOpenControl enables TCP Fast Open on listener socket
+func fastOpenControl(_, _ string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueueLen)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errFastOpenNotSupported = errors.New("tcp fast open not supported")
+
+func fastOpenControl(string, string, syscall.RawConn) error {
+	return errFastOpenNotSupported
+}
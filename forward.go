@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// forwardParent is parent http proxy of -forward-proxy
+type forwardParent struct {
+	Addr   string
+	URL    *url.URL // proxy url for http requests
+	Weight int
+	Dialer *httpProxyDialer
+
+	current   int       // smooth weighted round robin state
+	downUntil time.Time // passively marked down after connection error
+}
+
+// forwardPool spreads requests over parent proxies with weighted round robin,
+// parent failed to connect is skipped for cooldown
+type forwardPool struct {
+	Parents  []*forwardParent
+	Cooldown time.Duration
+
+	mu sync.Mutex
+}
+
+// setupForwardProxy adds forward egress of parent proxies from -forward-proxy,
+// and uses it as default route
+func setupForwardProxy(list []string) error {
+	d := dialer
+	d.ControlContext = nil // dial to proxy
+
+	pool := forwardPool{Cooldown: *forwardProxyCooldown}
+	for _, s := range list {
+		p, err := parseForwardParent(s)
+		if err != nil {
+			return err
+		}
+		p.Dialer = &httpProxyDialer{Addr: p.Addr, Forward: &d}
+		if u := p.URL.User; u != nil {
+			pass, _ := u.Password()
+			p.Dialer.Auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass))
+		}
+		pool.Parents = append(pool.Parents, p)
+	}
+	if len(pool.Parents) == 0 {
+		return fmt.Errorf("no forward proxy")
+	}
+
+	eg := egress{
+		Name:      "forward",
+		Dial:      parentDial(pool.DialContext),
+		Transport: newTransport(pool.dialParent(&d)),
+		Parent:    pool.proxyURL,
+		Proxied:   true,
+	}
+	eg.Transport.Proxy = eg.proxy
+	egresses[eg.Name] = &eg
+	defaultRoute = &eg
+	return nil
+}
+
+// parseForwardParent parses [user:pass@]host:port[=weight],
+// weight is parsed only after userinfo since password may contain '='
+func parseForwardParent(s string) (*forwardParent, error) {
+	userinfo, hostport := "", s
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		userinfo, hostport = s[:i+1], s[i+1:]
+	}
+	weight := 1
+	if h, v, ok := strings.Cut(hostport, "="); ok {
+		w, err := strconv.Atoi(v)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid forward proxy %s: invalid weight", s)
+		}
+		hostport, weight = h, w
+	}
+	u, err := url.Parse("http://" + userinfo + hostport)
+	if err != nil || u.Port() == "" || u.Path != "" {
+		return nil, fmt.Errorf("invalid forward proxy %s", s)
+	}
+	return &forwardParent{
+		Addr:   u.Host,
+		URL:    u,
+		Weight: weight,
+	}, nil
+}
+
+// pick returns next parent not in tried with smooth weighted round robin,
+// parents marked down are used only when all others are down
+func (p *forwardPool) pick(tried []*forwardParent) *forwardParent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var candidates []*forwardParent
+	for _, x := range p.Parents {
+		if !slices.Contains(tried, x) && now.After(x.downUntil) {
+			candidates = append(candidates, x)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, x := range p.Parents {
+			if !slices.Contains(tried, x) {
+				candidates = append(candidates, x)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var best *forwardParent
+	total := 0
+	for _, x := range candidates {
+		x.current += x.Weight
+		total += x.Weight
+		if best == nil || x.current > best.current {
+			best = x
+		}
+	}
+	best.current -= total
+	return best
+}
+
+func (p *forwardPool) success(x *forwardParent) {
+	forwardProxyDials.WithLabelValues(x.Addr, "success").Inc()
+}
+
+func (p *forwardPool) failure(x *forwardParent) {
+	forwardProxyDials.WithLabelValues(x.Addr, "failure").Inc()
+
+	p.mu.Lock()
+	x.downUntil = time.Now().Add(p.Cooldown)
+	p.mu.Unlock()
+}
+
+// DialContext dials addr through parent proxies,
+// fails over to next parent on connection error
+func (p *forwardPool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var (
+		tried []*forwardParent
+		err   error
+	)
+	for {
+		x := p.pick(tried)
+		if x == nil {
+			return nil, err
+		}
+		var conn net.Conn
+		conn, err = x.Dialer.DialContext(ctx, network, addr)
+		var parentErr *parentProxyError
+		if err == nil || errors.As(err, &parentErr) {
+			// parent is reachable even if it rejects destination
+			p.success(x)
+			return conn, err
+		}
+		p.failure(x)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		tried = append(tried, x)
+	}
+}
+
+// proxyURL selects parent proxy for http request,
+// called once per request by egress withParent
+func (p *forwardPool) proxyURL(*http.Request) (*url.URL, error) {
+	return p.pick(nil).URL, nil
+}
+
+// dialParent returns dial function for http transport to connect to selected parent,
+// fails over to parent with the same credentials
+// since transport already decided Proxy-Authorization from selected parent
+func (p *forwardPool) dialParent(d *net.Dialer) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		i := slices.IndexFunc(p.Parents, func(x *forwardParent) bool { return x.Addr == addr })
+		if i < 0 {
+			return d.DialContext(ctx, network, addr)
+		}
+		selected := p.Parents[i]
+
+		var tried []*forwardParent
+		x := selected
+		for {
+			conn, err := d.DialContext(ctx, network, x.Addr)
+			if err == nil {
+				p.success(x)
+				return conn, nil
+			}
+			p.failure(x)
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			tried = append(tried, x)
+
+			x = p.pick(tried)
+			for x != nil && x.URL.User.String() != selected.URL.User.String() {
+				tried = append(tried, x)
+				x = p.pick(tried)
+			}
+			if x == nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseForwardParent(t *testing.T) {
+	cases := []struct {
+		in     string
+		addr   string
+		user   string
+		pass   string
+		weight int
+		err    bool
+	}{
+		{in: "p1:3128", addr: "p1:3128", weight: 1},
+		{in: "p1:3128=3", addr: "p1:3128", weight: 3},
+		{in: "u:pw@p1:3128", addr: "p1:3128", user: "u", pass: "pw", weight: 1},
+		{in: "u:a=b@p1:3128", addr: "p1:3128", user: "u", pass: "a=b", weight: 1},
+		{in: "u:a=b@p1:3128=2", addr: "p1:3128", user: "u", pass: "a=b", weight: 2},
+		{in: "p1:3128=0", err: true},
+		{in: "p1:3128=x", err: true},
+		{in: "p1", err: true},
+	}
+	for _, c := range cases {
+		p, err := parseForwardParent(c.in)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.in, err)
+			continue
+		}
+		pass, _ := p.URL.User.Password()
+		if p.Addr != c.addr || p.URL.User.Username() != c.user || pass != c.pass || p.Weight != c.weight {
+			t.Errorf("%s: got addr=%s user=%s pass=%s weight=%d", c.in, p.Addr, p.URL.User.Username(), pass, p.Weight)
+		}
+	}
+}
+
+func TestForwardParentSelectedOnce(t *testing.T) {
+	var pool forwardPool
+	for _, s := range []string{"p1:3128=2", "p2:3128"} {
+		p, err := parseForwardParent(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.Parents = append(pool.Parents, p)
+	}
+	eg := egress{Name: "forward", Parent: pool.proxyURL}
+
+	count := map[string]int{}
+	for range 30 {
+		r, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r = eg.withParent(r)
+
+		// inspection must not select again
+		if !eg.viaParent(r) || !eg.viaParent(r) {
+			t.Fatal("expected request via parent")
+		}
+		u, err := eg.proxy(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u2, _ := eg.proxy(r)
+		if u != u2 {
+			t.Fatal("parent changed within request")
+		}
+		count[u.Host]++
+	}
+	if count["p1:3128"] != 20 || count["p2:3128"] != 10 {
+		t.Errorf("weights not honored: %v", count)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var errDestinationDenied = errors.New("destination denied")
+
+var (
+	geoipDB        *maxminddb.Reader
+	allowCountries []string
+	denyCountries  []string
+)
+
+func openGeoIP(filename string) error {
+	db, err := maxminddb.Open(filename)
+	if err != nil {
+		return err
+	}
+	geoipDB = db
+	return nil
+}
+
+func parseCountries(s string) []string {
+	xs := splitList(s)
+	for i := range xs {
+		xs[i] = strings.ToUpper(xs[i])
+	}
+	return xs
+}
+
+// ipCountry returns iso country code of ip
+func ipCountry(ip net.IP) (string, error) {
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	err := geoipDB.Lookup(ip, &rec)
+	if err != nil {
+		return "", err
+	}
+	return rec.Country.ISOCode, nil
+}
+
+// countryAllowed reports whether ip's country allowed
+func countryAllowed(ip net.IP) (bool, error) {
+	if geoipDB == nil {
+		return true, nil
+	}
+
+	country, err := ipCountry(ip)
+	if err != nil {
+		return false, err
+	}
+	if slices.Contains(denyCountries, country) {
+		return false, nil
+	}
+	if len(allowCountries) > 0 && !slices.Contains(allowCountries, country) {
+		return false, nil
+	}
+	return true, nil
+}
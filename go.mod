@@ -2,10 +2,28 @@ module github.com/acoshift/httpproxy
 
 go 1.23.4
 
-require github.com/moonrhythm/parapet v0.13.4
+require (
+	github.com/go-ldap/ldap/v3 v3.4.10
+	github.com/moonrhythm/parapet v0.13.4
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/prometheus/client_golang v1.19.0
+	golang.org/x/net v0.33.0
+	golang.org/x/sys v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.7 // indirect
+	github.com/google/brotli/go/cbrotli v0.0.0-20240221103305-ccec9628e492 // indirect
+	github.com/google/uuid v1.6.0 // indirect
 	github.com/kavu/go_reuseport v1.5.0 // indirect
-	golang.org/x/net v0.32.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/protobuf v1.32.0 // indirect
 )
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// streamConn adapts an HTTP/2 CONNECT stream into net.Conn
+type streamConn struct {
+	r    *http.Request
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	body io.ReadCloser
+}
+
+func newStreamConn(w http.ResponseWriter, r *http.Request) *streamConn {
+	return &streamConn{
+		r:    r,
+		w:    w,
+		rc:   http.NewResponseController(w),
+		body: r.Body,
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+func (c *streamConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	if addr, ok := c.r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return nil
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.r.RemoteAddr)
+	return addr
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// matchHost reports whether host matches pattern,
+// pattern can be exact host, *.example.com for any subdomain, or * for all hosts
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if pattern == "*" {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+	return pattern == host
+}
+
+// matchHosts reports whether host matches any of patterns
+func matchHosts(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if matchHost(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns ip of connected client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// targetHost returns destination host of proxy request without port
+func targetHost(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		host, _, err := net.SplitHostPort(r.RequestURI)
+		if err != nil {
+			return r.RequestURI
+		}
+		return host
+	}
+	return r.URL.Hostname()
+}
+
+// validHostname reports whether s is ip or hostname
+func validHostname(s string) bool {
+	if s == "" || len(s) > 255 {
+		return false
+	}
+	if _, err := netip.ParseAddr(s); err == nil {
+		return true
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// unescapeZone decodes percent-encoded zone of bracketed IPv6 literal (RFC 6874),
+// ex. [fe80::1%25eth0]:443 to [fe80::1%eth0]:443
+func unescapeZone(s string) string {
+	i := strings.Index(s, "%25")
+	if i < 0 || !strings.HasPrefix(s, "[") {
+		return s
+	}
+	return s[:i] + "%" + s[i+3:]
+}
+
+// connectHost returns intended hostname of CONNECT to ip from X-Proxy-Connect-Host header,
+// header is always removed from request
+func connectHost(r *http.Request) string {
+	h := r.Header.Get("X-Proxy-Connect-Host")
+	r.Header.Del("X-Proxy-Connect-Host")
+	if !*trustConnectHost || h == "" {
+		return ""
+	}
+
+	target, _, err := net.SplitHostPort(r.RequestURI)
+	if err != nil {
+		target = strings.TrimSuffix(strings.TrimPrefix(r.RequestURI, "["), "]")
+	}
+	if net.ParseIP(target) == nil || net.ParseIP(h) != nil || !validHostname(h) {
+		return ""
+	}
+	return strings.ToLower(h)
+}
+
+// parseCIDR parses cidr, or single ip as host network
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %s", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// parseCIDRs parses list of cidr or ip
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var ns []*net.IPNet
+	for _, s := range list {
+		n, err := parseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+// containsIP reports whether ip is in any of networks
+func containsIP(ns []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range ns {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestConnectTargetIPv6(t *testing.T) {
+	cases := []struct {
+		in   string
+		addr string // after unescapeZone
+		host string
+		port string
+	}{
+		{"[2001:db8::1]:443", "[2001:db8::1]:443", "2001:db8::1", "443"},
+		{"[fe80::1%eth0]:443", "[fe80::1%eth0]:443", "fe80::1%eth0", "443"},
+		{"[fe80::1%25eth0]:443", "[fe80::1%eth0]:443", "fe80::1%eth0", "443"},
+		{"[fe80::1%25en0.1]:8443", "[fe80::1%en0.1]:8443", "fe80::1%en0.1", "8443"},
+		{"example.com:443", "example.com:443", "example.com", "443"},
+		{"192.0.2.1:443", "192.0.2.1:443", "192.0.2.1", "443"},
+	}
+	for _, c := range cases {
+		addr := unescapeZone(c.in)
+		if addr != c.addr {
+			t.Errorf("unescapeZone(%s): expected %s, got %s", c.in, c.addr, addr)
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host != c.host || port != c.port {
+			t.Errorf("SplitHostPort(%s): got %s %s %v", addr, host, port, err)
+			continue
+		}
+		if !validHostname(host) {
+			t.Errorf("validHostname(%s): expected valid", host)
+		}
+
+		r := &http.Request{Method: http.MethodConnect, RequestURI: addr}
+		if h := targetHost(r); h != c.host {
+			t.Errorf("targetHost(%s): expected %s, got %s", addr, c.host, h)
+		}
+	}
+}
+
+func TestConnectZonedIPv6(t *testing.T) {
+	lo, err := net.InterfaceByIndex(1)
+	if err != nil || lo.Flags&net.FlagLoopback == 0 {
+		t.Skip("loopback interface not found")
+	}
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback not available")
+	}
+	ln.Close()
+
+	upstream := startTCPUpstreamAddr(t, "[::1]:0", func(conn net.Conn) { io.Copy(conn, conn) })
+	_, port, _ := net.SplitHostPort(upstream)
+
+	// zone is percent-encoded in CONNECT target
+	code, conn := dialTunnel(t, startProxy(t), "[::1%25"+lo.Name+"]:"+port)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("unexpected echo %q: %v", buf, err)
+	}
+}
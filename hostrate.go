@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// byteLimiter is token bucket limiting bytes per second,
+// burst is one second of rate
+type byteLimiter struct {
+	Rate float64 // bytes per second
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	refs   int // connections using limiter, guarded by hostRateRegistry
+}
+
+// newByteLimiter returns limiter of rate bytes per second, nil if rate is not positive
+func newByteLimiter(rate int) *byteLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteLimiter{
+		Rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until n bytes are allowed
+func (l *byteLimiter) Wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.Rate, l.tokens+now.Sub(l.last).Seconds()*l.Rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.Rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(d)
+}
+
+// rateWriter delays writes to stay within limiter rate
+type rateWriter struct {
+	w io.Writer
+	l *byteLimiter
+}
+
+func (w *rateWriter) Write(p []byte) (int, error) {
+	w.l.Wait(len(p))
+	return w.w.Write(p)
+}
+
+// limitWriter wraps w with limiter, returns w if limiter is nil
+func limitWriter(w io.Writer, l *byteLimiter) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &rateWriter{w: w, l: l}
+}
+
+// hostRateRegistry shares byte limiter between connections to the same destination host
+type hostRateRegistry struct {
+	mu sync.Mutex
+	m  map[string]*byteLimiter // removed when no connection uses it
+}
+
+var hostRates = hostRateRegistry{m: make(map[string]*byteLimiter)}
+
+// Acquire returns limiter of host, nil if -per-host-rate is disabled
+func (reg *hostRateRegistry) Acquire(host string) *byteLimiter {
+	if *perHostRate <= 0 {
+		return nil
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	l := reg.m[host]
+	if l == nil {
+		l = newByteLimiter(*perHostRate)
+		reg.m[host] = l
+	}
+	l.refs++
+	return l
+}
+
+// Release releases limiter acquired by Acquire
+func (reg *hostRateRegistry) Release(host string) {
+	if *perHostRate <= 0 {
+		return
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	l := reg.m[host]
+	if l == nil {
+		return
+	}
+	l.refs--
+	if l.refs <= 0 {
+		delete(reg.m, host)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	logExcludePaths []string
+	logExcludeNets  []*net.IPNet
+)
+
+// parseLogExclude parses -log-exclude entries,
+// entry is either path (trailing * for prefix), ip, or cidr
+func parseLogExclude(list []string) error {
+	for _, x := range list {
+		if strings.HasPrefix(x, "/") {
+			logExcludePaths = append(logExcludePaths, x)
+			continue
+		}
+		n, err := parseCIDR(x)
+		if err != nil {
+			return fmt.Errorf("invalid log exclude %s", x)
+		}
+		logExcludeNets = append(logExcludeNets, n)
+	}
+	return nil
+}
+
+// logEnabled reports whether request should be logged,
+// paths are excluded only for requests to proxy itself
+func logEnabled(r *http.Request) bool {
+	if !*enableLog && *accessLogFile == "" {
+		return false
+	}
+	if isDirect(r) {
+		for _, p := range logExcludePaths {
+			if p == r.URL.Path || (strings.HasSuffix(p, "*") && strings.HasPrefix(r.URL.Path, p[:len(p)-1])) {
+				return false
+			}
+		}
+	}
+	if len(logExcludeNets) > 0 && containsIP(logExcludeNets, net.ParseIP(clientIP(r))) {
+		return false
+	}
+	return true
+}
+
+// logResponseWriter records response status and bytes written
+type logResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *logResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *logResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *logResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countReadCloser records bytes read,
+// transport may still be reading when handler returns
+type countReadCloser struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (r *countReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// upstreamInfo records egress and upstream connection of http request for logging
+type upstreamInfo struct {
+	mu       sync.Mutex
+	egress   string
+	override string // address dialed instead of requested host by -upstream-override
+	remote   string
+	local    string
+}
+
+type upstreamInfoKey struct{}
+
+// withUpstreamInfo returns request that records its upstream info
+func withUpstreamInfo(r *http.Request) (*http.Request, *upstreamInfo) {
+	info := &upstreamInfo{}
+	return r.WithContext(context.WithValue(r.Context(), upstreamInfoKey{}, info)), info
+}
+
+// trackUpstream records egress of request and adds trace to record upstream connection,
+// request is returned unchanged if it does not record upstream info
+func trackUpstream(r *http.Request, eg *egress) *http.Request {
+	info, _ := r.Context().Value(upstreamInfoKey{}).(*upstreamInfo)
+	if info == nil {
+		return r
+	}
+
+	// override applies to parent proxy address, not destination, when forwarding through parent
+	var override string
+	if !eg.viaParent(r) {
+		if addr := urlAddr(r.URL); overrideAddr(addr) != addr {
+			override = overrideAddr(addr)
+		}
+	}
+
+	info.mu.Lock()
+	info.egress = eg.Name
+	info.override = override
+	info.mu.Unlock()
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+		GotConn: func(ci httptrace.GotConnInfo) {
+			info.mu.Lock()
+			info.remote = ci.Conn.RemoteAddr().String()
+			info.local = ci.Conn.LocalAddr().String()
+			info.mu.Unlock()
+		},
+	}))
+}
+
+// logArgs returns upstream info for logging, nil if request was not sent
+func (info *upstreamInfo) logArgs() []any {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	if info.egress == "" {
+		return nil
+	}
+	args := []any{"egress", info.egress}
+	if info.override != "" {
+		args = append(args, "override_addr", info.override)
+	}
+	if info.remote != "" {
+		args = append(args, "upstream_addr", info.remote, "local_addr", info.local)
+	}
+	return args
+}
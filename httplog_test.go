@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestTunnelTLSLogExcluded(t *testing.T) {
+	var buf syncBuffer
+	log := accessLog
+	accessLog = slog.New(slog.NewTextHandler(&buf, nil))
+	*enableLog, *logSNI = true, true
+	t.Cleanup(func() {
+		accessLog = log
+		*enableLog, *logSNI = false, false
+		logExcludeNets = nil
+	})
+
+	target := startTCPUpstream(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	proxyURL := startProxy(t)
+	sendHello := func() {
+		code, conn := dialTunnel(t, proxyURL, target)
+		if code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+		conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake()
+		conn.Close()
+		for tunnels.Len() > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	sendHello()
+	if !strings.Contains(buf.String(), "tunnel tls") {
+		t.Fatal("expected tunnel tls logged")
+	}
+
+	if err := parseLogExclude([]string{"127.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	buf.b.Reset()
+	sendHello()
+	if s := buf.String(); s != "" {
+		t.Errorf("expected nothing logged for excluded client, got %s", s)
+	}
+}
+
+func TestLogExcludePathDirectOnly(t *testing.T) {
+	*enableLog = true
+	t.Cleanup(func() {
+		*enableLog = false
+		logExcludePaths = nil
+	})
+	if err := parseLogExclude([]string{"/healthz", "/metrics*"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		uri     string
+		enabled bool
+	}{
+		{"/healthz", false},
+		{"/metrics/proxy", false},
+		{"/other", true},
+		{"http://example.com/healthz", true},
+		{"http://example.com/metrics", true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, c.uri, nil)
+		if got := logEnabled(r); got != c.enabled {
+			t.Errorf("%s: expected %v, got %v", c.uri, c.enabled, got)
+		}
+	}
+}
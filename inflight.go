@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+)
+
+// inflightLimiter limits concurrent requests and tunnels per destination host
+type inflightLimiter struct {
+	mu sync.Mutex
+	m  map[string]int // host => in-flight count, removed when reaches zero
+}
+
+var inflight = inflightLimiter{m: make(map[string]int)}
+
+// Acquire reserves in-flight slot for host,
+// it reports false if host reached -max-inflight-per-host
+func (l *inflightLimiter) Acquire(host string) bool {
+	if *maxInflightPerHost <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := l.m[host]
+	if n >= *maxInflightPerHost {
+		inflightRejects.Inc()
+		return false
+	}
+	l.m[host] = n + 1
+	inflightRequests.WithLabelValues(host).Set(float64(n + 1))
+	return true
+}
+
+// Release releases slot acquired by Acquire
+func (l *inflightLimiter) Release(host string) {
+	if *maxInflightPerHost <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := l.m[host] - 1
+	if n <= 0 {
+		delete(l.m, host)
+		inflightRequests.DeleteLabelValues(host)
+		return
+	}
+	l.m[host] = n
+	inflightRequests.WithLabelValues(host).Set(float64(n))
+}
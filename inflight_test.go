@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestInflightDisabled(t *testing.T) {
+	l := inflightLimiter{m: make(map[string]int)}
+	for range 3 {
+		if !l.Acquire("example.com") {
+			t.Fatal("expected acquire without limit")
+		}
+	}
+	if len(l.m) != 0 {
+		t.Error("expected no tracking without limit")
+	}
+	l.Release("example.com")
+}
+
+func TestInflightLimit(t *testing.T) {
+	*maxInflightPerHost = 1
+	t.Cleanup(func() { *maxInflightPerHost = 0 })
+
+	l := inflightLimiter{m: make(map[string]int)}
+	if !l.Acquire("example.com") {
+		t.Fatal("expected first acquire")
+	}
+	if l.Acquire("example.com") {
+		t.Fatal("expected limit reached")
+	}
+	l.Release("example.com")
+	if !l.Acquire("example.com") {
+		t.Fatal("expected acquire after release")
+	}
+	l.Release("example.com")
+	if len(l.m) != 0 {
+		t.Error("expected host removed when no in-flight")
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/moonrhythm/parapet"
+)
+
+// landingPage serves page for direct request to proxy root,
+// other direct paths are still not found
+func landingPage(body []byte) parapet.Middleware {
+	ctype := http.DetectContentType(body)
+	modTime := time.Now()
+
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isDirect(r) || r.URL.Path != "/" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Type", ctype)
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+		})
+	})
+}
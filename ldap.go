@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/moonrhythm/parapet/pkg/authn"
+)
+
+const ldapTimeout = 10 * time.Second
+
+var ldapAuth *ldapAuthenticator
+
+// setupLDAP configs LDAP authenticator from flags and config
+func setupLDAP(cfg *config) error {
+	if *ldapUserDN == "" && *ldapBaseDN == "" {
+		return fmt.Errorf("ldap: base dn or user dn required")
+	}
+
+	a := ldapAuthenticator{
+		URL:          *ldapURL,
+		BaseDN:       *ldapBaseDN,
+		BindDN:       *ldapBindDN,
+		BindPassword: *ldapBindPassword,
+		UserFilter:   *ldapUserFilter,
+		UserDN:       *ldapUserDN,
+		CacheTTL:     *ldapCacheTTL,
+		cache:        make(map[string]*ldapCacheEntry),
+	}
+	for _, c := range cfg.LDAPGroups {
+		if c.Group == "" {
+			return fmt.Errorf("ldap group: missing group")
+		}
+		g := ldapGroup{
+			DN:         c.Group,
+			AllowHosts: c.AllowHosts,
+			Exits:      c.Exits,
+		}
+		if c.Egress != "" {
+			g.Egress = egresses[c.Egress]
+			if g.Egress == nil {
+				return fmt.Errorf("ldap group %s: egress %s not found", c.Group, c.Egress)
+			}
+		}
+		a.Groups = append(a.Groups, g)
+	}
+	ldapAuth = &a
+	return nil
+}
+
+// ldapGroup maps members of group to user settings
+type ldapGroup struct {
+	DN         string
+	Egress     *egress
+	AllowHosts []string
+	Exits      []string
+}
+
+type ldapCacheEntry struct {
+	Password [sha256.Size]byte
+	User     *user
+	Expires  time.Time
+}
+
+// ldapAuthenticator authenticates Basic credentials by binding to LDAP as the user
+type ldapAuthenticator struct {
+	URL          string
+	BaseDN       string
+	BindDN       string // empty for anonymous search
+	BindPassword string
+	UserFilter   string // %s is replaced by username
+	UserDN       string // bind directly without search when set, %s is replaced by username
+	CacheTTL     time.Duration
+
+	// Groups maps groups to user settings, first matched group is used.
+	// When not empty, user must be member of one of the groups.
+	Groups []ldapGroup
+
+	mu    sync.Mutex
+	cache map[string]*ldapCacheEntry
+}
+
+func (a *ldapAuthenticator) Authenticate(r *http.Request) (string, error) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", authn.ErrMissingAuthorization
+	}
+	username, password, ok := parseBasicAuth(auth)
+	// empty password is unauthenticated bind, which always succeeds
+	if !ok || username == "" || password == "" {
+		return "", authn.ErrInvalidCredentials
+	}
+
+	hash := sha256.Sum256([]byte(password))
+	if a.cached(username, hash) {
+		return username, nil
+	}
+
+	u, err := a.login(username, password)
+	if errors.Is(err, authn.ErrInvalidCredentials) {
+		return "", err
+	}
+	if err != nil {
+		slog.Error("ldap error", "user", username, "error", err)
+		return "", &authBackendError{Identity: username, Err: err}
+	}
+
+	a.mu.Lock()
+	a.cache[username] = &ldapCacheEntry{
+		Password: hash,
+		User:     u,
+		Expires:  time.Now().Add(a.CacheTTL),
+	}
+	a.mu.Unlock()
+	return username, nil
+}
+
+func (*ldapAuthenticator) Schemes() []string {
+	return []string{"Basic"}
+}
+
+func (a *ldapAuthenticator) cached(username string, hash [sha256.Size]byte) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e := a.cache[username]
+	if e == nil {
+		return false
+	}
+	if time.Now().After(e.Expires) {
+		delete(a.cache, username)
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash[:], e.Password[:]) == 1
+}
+
+// user returns settings of user authenticated within cache ttl
+func (a *ldapAuthenticator) user(username string) *user {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if e := a.cache[username]; e != nil && time.Now().Before(e.Expires) {
+		return e.User
+	}
+	return nil
+}
+
+func (a *ldapAuthenticator) login(username, password string) (*user, error) {
+	conn, err := ldap.DialURL(a.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+
+	dn, err := a.userDN(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Bind(dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, authn.ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bind user; %w", err)
+	}
+
+	u := user{Name: username}
+	if len(a.Groups) == 0 {
+		return &u, nil
+	}
+
+	groups, err := a.memberOf(conn, dn)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range a.Groups {
+		for _, x := range groups {
+			if strings.EqualFold(x, g.DN) {
+				u.Egress = g.Egress
+				u.AllowHosts = g.AllowHosts
+				u.Exits = g.Exits
+				return &u, nil
+			}
+		}
+	}
+	return nil, authn.ErrInvalidCredentials
+}
+
+func (a *ldapAuthenticator) userDN(conn *ldap.Conn, username string) (string, error) {
+	if a.UserDN != "" {
+		return fmt.Sprintf(a.UserDN, ldap.EscapeDN(username)), nil
+	}
+
+	if a.BindDN != "" {
+		err := conn.Bind(a.BindDN, a.BindPassword)
+		if err != nil {
+			return "", fmt.Errorf("bind search user; %w", err)
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		fmt.Sprintf(a.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn"},
+		nil,
+	))
+	if err != nil {
+		return "", fmt.Errorf("search user; %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return "", authn.ErrInvalidCredentials
+	}
+	return res.Entries[0].DN, nil
+}
+
+func (a *ldapAuthenticator) memberOf(conn *ldap.Conn, dn string) ([]string, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(ldapTimeout/time.Second), false,
+		"(objectClass=*)",
+		[]string{"memberOf"},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("search groups; %w", err)
+	}
+	if len(res.Entries) == 0 {
+		return nil, nil
+	}
+	return res.Entries[0].GetAttributeValues("memberOf"), nil
+}
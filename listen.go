@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/moonrhythm/parapet"
+)
+
+// connModifiers are applied to accepted connections of listener created by listenAndServe
+var connModifiers []func(conn net.Conn) net.Conn
+
+// modifyConnection registers f to modify accepted connections
+func modifyConnection(srv *parapet.Server, f func(conn net.Conn) net.Conn) {
+	srv.ModifyConnection(f)
+	connModifiers = append(connModifiers, f)
+}
+
+// listenAndServe starts server,
+// parapet does not expose listener socket options,
+// so listener is created here when -tcp-fastopen is enabled
+func listenAndServe(srv *parapet.Server) error {
+	if !*tcpFastOpen {
+		return srv.ListenAndServe()
+	}
+
+	lc := net.ListenConfig{Control: fastOpenControl}
+	ln, err := lc.Listen(context.Background(), "tcp", srv.Addr)
+	if errors.Is(err, errFastOpenNotSupported) {
+		slog.Warn("tcp fast open is not supported on this platform, ignored")
+		return srv.ListenAndServe()
+	}
+	if err != nil {
+		return err
+	}
+	ln = &modifyConnListener{Listener: ln}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+
+	// same as parapet, shutdown gracefully on SIGTERM
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-shutdown:
+		return srv.Shutdown()
+	}
+}
+
+type modifyConnListener struct {
+	net.Listener
+}
+
+func (ln *modifyConnListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range connModifiers {
+		conn = f(conn)
+	}
+	return conn, nil
+}
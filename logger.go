@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// accessLog logs proxied requests and tunnels
+var accessLog = slog.Default()
+
+// logLevel is minimum level of default logger, can be changed at runtime with setLogLevel
+var logLevel slog.LevelVar
+
+// setupLogger sets default logger from -log-encoding and -log-level,
+// and access logger from -access-log
+func setupLogger() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevelName)); err != nil {
+		return fmt.Errorf("invalid log level %s", *logLevelName)
+	}
+
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	switch *logEncoding {
+	case "text":
+		// keep default logger
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	case "logfmt":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("invalid log encoding %s", *logEncoding)
+	}
+	setLogLevel(level)
+
+	accessLog = slog.Default()
+	if *accessLogFile == "" {
+		return nil
+	}
+
+	var w io.Writer
+	switch *accessLogFile {
+	case "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		f, err := os.OpenFile(*accessLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	switch *accessLogEncoding {
+	case "json":
+		accessLog = slog.New(slog.NewJSONHandler(w, nil))
+	case "logfmt":
+		accessLog = slog.New(slog.NewTextHandler(w, nil))
+	default:
+		return fmt.Errorf("invalid access log encoding %s", *accessLogEncoding)
+	}
+	return nil
+}
+
+// setLogLevel sets minimum level of default logger
+func setLogLevel(level slog.Level) {
+	logLevel.Set(level)
+	if *logEncoding == "text" {
+		// default handler does not take leveler
+		slog.SetLogLoggerLevel(level)
+	}
+}
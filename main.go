@@ -1,20 +1,28 @@
 package main
 
 import (
-	"crypto/subtle"
-	"encoding/base64"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/moonrhythm/parapet"
 	"github.com/moonrhythm/parapet/pkg/authn"
-	"github.com/moonrhythm/parapet/pkg/upstream"
+	"github.com/moonrhythm/parapet/pkg/compress"
+	"golang.org/x/net/http/httpguts"
 )
 
 var (
@@ -23,63 +31,594 @@ var (
 	authPass  = flag.String("auth-pass", "", "Basic Password for Proxy-Authorization")
 	port      = flag.String("port", "18888", "Port to start server")
 	enableLog = flag.Bool("log", false, "Enable log to stderr")
+
+	enableH2C  = flag.Bool("h2c", false, "Enable HTTP/2 cleartext (h2c) on listener")
+	configFile = flag.String("config", "", "Config file for egress routing, or directory of *.yaml files merged in lexical order")
+	adminAddr  = flag.String("admin-addr", "", "Address to start admin server (ex. 127.0.0.1:18889), empty to disable")
+	serviceCmd = flag.String("service", "", "Windows service command (install, uninstall, run)")
+
+	httpTimeout        = flag.Duration("http-timeout", 0, "Timeout for HTTP round trip, 0 to use default (1m)")
+	allowTimeoutHeader = flag.Bool("allow-timeout-header", false, "Allow X-Proxy-Timeout header to override HTTP round trip timeout")
+	maxTimeoutHeader   = flag.Duration("max-timeout-header", 5*time.Minute, "Maximum timeout allowed from X-Proxy-Timeout header")
+
+	tarpitDuration = flag.Duration("tarpit", 0, "Hold denied requests open with slow 403 response for given duration, 0 to disable")
+	tarpitMax      = flag.Int("tarpit-max", 100, "Maximum concurrent tarpitted requests, exceeded requests are rejected immediately")
+
+	rewriteStatusRules = flag.String("rewrite-status", "", "Rewrite upstream response status (ex. 451=403,402=403)")
+	rewriteStatusBody  = flag.String("rewrite-status-body", "", "Response body for rewritten status, empty to keep upstream body")
+
+	breakerThreshold = flag.Int("breaker-threshold", 0, "Consecutive failures to a host within window to open circuit breaker, 0 to disable")
+	breakerWindow    = flag.Duration("breaker-window", 30*time.Second, "Circuit breaker failure counting window")
+	breakerCooldown  = flag.Duration("breaker-cooldown", 30*time.Second, "Circuit breaker open duration before probing host again")
+
+	errorFormat = flag.String("error-format", "text", "Format of proxy generated error responses (text, json)")
+
+	readinessProbe = flag.String("readiness-probe", "", "URL to probe through egress before reporting ready (http:// fetch, https:// connect)")
+
+	enableCompress = flag.Bool("compress", false, "Gzip uncompressed HTTP responses for clients that accept gzip")
+
+	followRedirects = flag.Int("follow-redirects", 0, "Maximum http:// redirects to follow on behalf of client, 0 to disable")
+
+	defaultConnectPort = flag.String("default-connect-port", "", "Port for CONNECT target without port (ex. 443), empty to reject")
+
+	tcpNoDelay = flag.Bool("tcp-nodelay", true, "Set TCP_NODELAY on tunnel connections")
+	soSndBuf   = flag.Int("so-sndbuf", 0, "Socket send buffer size for tunnel connections, 0 to use system default")
+	soRcvBuf   = flag.Int("so-rcvbuf", 0, "Socket receive buffer size for tunnel connections, 0 to use system default")
+	logSNI     = flag.Bool("log-sni", false, "Log TLS SNI and ALPN sent by client inside tunnels")
+
+	connectFirstByteTimeout = flag.Duration("connect-first-byte-timeout", 0, "Close tunnel if upstream sends no data within duration after connect, 0 to disable")
+
+	allowHost   = flag.String("allow-host", "", "Comma separated destination hosts to allow (ex. example.com,*.example.com)")
+	denyHost    = flag.String("deny-host", "", "Comma separated destination hosts to deny")
+	defaultDeny = flag.Bool("default-deny", false, "Deny destinations not matching allow hosts")
+
+	geoipFile    = flag.String("geoip-db", "", "MaxMind country database (mmdb) for country policy")
+	allowCountry = flag.String("allow-country", "", "Comma separated ISO country codes of destination ip to allow, empty to allow all")
+	denyCountry  = flag.String("deny-country", "", "Comma separated ISO country codes of destination ip to deny")
+
+	ldapURL          = flag.String("ldap-url", "", "LDAP server URL to authenticate Basic credentials (ex. ldaps://ad.example.com)")
+	ldapBaseDN       = flag.String("ldap-base-dn", "", "LDAP base DN to search users")
+	ldapBindDN       = flag.String("ldap-bind-dn", "", "LDAP DN to bind before searching users, empty for anonymous search")
+	ldapBindPassword = flag.String("ldap-bind-password", "", "LDAP password of bind DN")
+	ldapUserFilter   = flag.String("ldap-user-filter", "(sAMAccountName=%s)", "LDAP filter to search user, %s is replaced by username")
+	ldapUserDN       = flag.String("ldap-user-dn", "", "LDAP DN template to bind as user without searching (ex. uid=%s,ou=people,dc=example,dc=com)")
+	ldapCacheTTL     = flag.Duration("ldap-cache-ttl", time.Minute, "Duration to cache successful LDAP authentication")
+
+	transparent = flag.Bool("transparent", false, "Proxy origin-form requests to destination in Host header (for iptables REDIRECT)")
+
+	logExclude = flag.String("log-exclude", "", "Comma separated request paths (trailing * for prefix) or client ip/cidr to exclude from log")
+
+	maxInflightPerHost = flag.Int("max-inflight-per-host", 0, "Maximum concurrent requests and tunnels to a destination host, 0 for unlimited")
+
+	tlsCert = flag.String("tls-cert", "", "TLS certificate file to serve proxy over TLS")
+	tlsKey  = flag.String("tls-key", "", "TLS private key file")
+
+	tlsMinVersion = flag.String("tls-min-version", "1.2", "Minimum TLS version of listener (1.0, 1.1, 1.2, 1.3)")
+	tlsCiphers    = flag.String("tls-ciphers", "", "Comma separated TLS 1.2 cipher suites of listener (ex. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), empty for default")
+
+	dnsCacheTTL    = flag.Duration("dns-cache-ttl", 0, "Duration to cache resolved destination addresses, 0 to disable")
+	dnsNegativeTTL = flag.Duration("dns-negative-ttl", 0, "Duration to cache not found destination hosts, 0 to disable")
+
+	trustConnectHost = flag.Bool("trust-connect-host", false, "Use X-Proxy-Connect-Host header as intended hostname of CONNECT to ip for log and deny hosts")
+
+	insecureUpstream = flag.Bool("insecure-upstream", false, "INSECURE: skip certificate verification of https origins, for lab environments only")
+
+	predrainDelay   = flag.Duration("predrain-delay", 10*time.Second, "Duration to fail readiness before shutting down server on SIGTERM")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "Duration to wait for active requests to finish on shutdown")
+
+	tunnelBufferSize = flag.Int("tunnel-buffer-size", 32*1024, "Buffer size for copying tunnel data in each direction")
+
+	mirrorURL     = flag.String("mirror-url", "", "URL to asynchronously replay copy of proxied HTTP requests to")
+	mirrorMaxBody = flag.Int64("mirror-max-body", 1<<20, "Maximum request body size to mirror, larger requests are not mirrored")
+
+	idlePruneInterval = flag.Duration("idle-prune-interval", 0, "Interval to close all idle upstream connections, 0 to disable")
+
+	logEncoding = flag.String("log-encoding", "text", "Log encoding (text, json, logfmt)")
+
+	allowHalfClose = flag.Bool("allow-half-close", false, "Keep tunnel open in other direction when one side finishes sending")
+
+	retryIdempotent = flag.Bool("retry-idempotent", false, "Retry GET, HEAD and OPTIONS requests once when upstream connection fails")
+
+	debugIdentityHeader = flag.String("debug-identity-header", "", "Response header to add authenticated identity to proxy generated responses (ex. X-Proxy-User), empty to disable")
+
+	maxURILength = flag.Int("max-uri-length", 8192, "Maximum request URI length, 0 for unlimited")
+
+	accessLogFile     = flag.String("access-log", "", "Access log destination (stderr, stdout, or file path), enables access log, empty to log with -log")
+	accessLogEncoding = flag.String("access-log-encoding", "json", "Access log encoding (json, logfmt)")
+
+	acceptRate  = flag.Float64("accept-rate", 0, "Maximum new connections accepted per second, excess connections are delayed, 0 for unlimited")
+	acceptBurst = flag.Int("accept-burst", 100, "Number of connections accepted at once before -accept-rate applies")
+
+	upstreamOverride = flag.String("upstream-override", "", "Comma separated host=addr to dial addr for matched destination host while keeping Host header (ex. example.com=10.0.0.1)")
+
+	trustForwarded = flag.String("trust-forwarded", "", "Comma separated ip/cidr of forwarders trusted to set destination with Forwarded header host in transparent mode")
+
+	adminToken = flag.String("admin-token", "", "Bearer Token for admin server, overrides proxy credentials on admin endpoints")
+
+	perHostRate = flag.Int("per-host-rate", 0, "Maximum bytes per second transferred with each destination host shared by all connections, 0 for unlimited")
+
+	recordDir     = flag.String("record-dir", "", "Directory to record http responses for -replay-dir, for testing only")
+	replayDir     = flag.String("replay-dir", "", "Directory to serve recorded http responses from instead of upstream, for testing only")
+	recordHeaders = flag.String("record-headers", "", "Comma separated request headers to match recorded responses in addition to method and url")
+
+	tunnelKeepAlive = flag.Duration("tunnel-keepalive", 0, "TCP keep-alive period for both ends of tunnel connections, 0 to use system default")
+
+	tcpFastOpen = flag.Bool("tcp-fastopen", false, "Enable TCP Fast Open on listener, ignored on unsupported platforms")
+
+	allowCIDR = flag.String("allow-cidr", "", "Comma separated ip/cidr of resolved destination ip to allow when -default-deny")
+	denyCIDR  = flag.String("deny-cidr", "", "Comma separated ip/cidr of resolved destination ip to deny")
+
+	enablePprof = flag.Bool("pprof", false, "Enable /debug/pprof on admin server")
+
+	tunnelDumpFile = flag.String("tunnel-dump-file", "", "File to write active tunnels on SIGUSR1, empty for stderr")
+
+	methodTimeout = flag.String("method-timeout", "", "Comma separated METHOD=duration to override -http-timeout by request method (ex. GET=10s,POST=2m)")
+
+	stripHeader = flag.String("strip-header", "X-Real-Ip,X-Forwarded-For,X-Forwarded-Proto", "Comma separated request headers to remove before forwarding http request")
+
+	landingPageFile = flag.String("landing-page", "", "HTML or text file to serve for direct request to proxy root")
+
+	bindIP    = flag.String("bind-ip", "", "Comma separated local ips to dial direct destinations from, each client sticks to one ip")
+	bindIPKey = flag.String("bind-ip-key", "ip", "Key to select -bind-ip for request (ip, user), user falls back to client ip when unauthenticated")
+
+	httpsOnlyHost = flag.String("https-only-host", "", "Comma separated hosts to deny plain http requests, must use CONNECT (ex. *.bank.com)")
+
+	tlsHandshakeTimeout = flag.Duration("tls-handshake-timeout", 10*time.Second, "Timeout for TLS handshake with https upstream, separate from dial timeout, 0 for no timeout")
+
+	maxResponseHeaders = flag.Int("max-response-headers", 1000, "Maximum number of upstream response header fields, larger response is refused with 502, 0 for unlimited")
+
+	connectTLSOnly  = flag.Bool("connect-tls-only", false, "Allow CONNECT only to common TLS ports in -connect-tls-ports")
+	connectTLSPorts = flag.String("connect-tls-ports", "443,8443,465,636,853,993,995", "Comma separated ports allowed for CONNECT with -connect-tls-only")
+
+	authRechallenge = flag.Bool("auth-rechallenge", false, "Challenge invalid credentials with 407 like missing credentials, instead of 401 without challenge")
+
+	proxySNIAllow = flag.String("proxy-sni-allow", "", "Comma separated server names allowed in TLS handshake of proxy listener, empty to allow any (ex. proxy.example.com)")
+
+	tenantHeader = flag.String("tenant-header", "X-Tenant", "Request header to select tenant from config, removed before forwarding")
+	tenantKey    = flag.String("tenant-key", "header", "Key to select tenant (header, user)")
+
+	httpTotalTimeout       = flag.Duration("http-total-timeout", 0, "Timeout for whole http request including response body, 0 for no timeout")
+	httpTotalTimeoutExempt = flag.String("http-total-timeout-exempt", "text/event-stream", "Comma separated streaming response content types exempted from -http-total-timeout (ex. text/event-stream,video/*)")
+
+	pushgatewayURL      = flag.String("pushgateway-url", "", "Prometheus Pushgateway url to push metrics to, empty to disable")
+	pushgatewayInterval = flag.Duration("pushgateway-interval", 15*time.Second, "Interval to push metrics to Pushgateway")
+	pushgatewayInstance = flag.String("pushgateway-instance", "", "Instance label of pushed metrics, empty to use hostname")
+
+	allowExitHeader = flag.Bool("allow-exit-header", false, "Allow authenticated users to select egress from exits in config by request header")
+	exitHeader      = flag.String("exit-header", "X-Proxy-Exit", "Request header to select exit from, removed before forwarding")
+
+	parentXFF = flag.Bool("parent-xff", false, "Append client ip to X-Forwarded-For of http request forwarded through parent proxy, independent of -strip-header")
+
+	hostIdleTimeout = flag.String("host-idle-timeout", "", "Comma separated host=duration to override 1m idle timeout of upstream connections by destination host (ex. api.example.com=10s,*.example.org=5s)")
+
+	strictHost = flag.Bool("strict-host", false, "Reject http request with missing Host or Host not matching absolute request uri with 400")
+
+	logLevelName = flag.String("log-level", "info", "Minimum log level (debug, info, warn, error), can be changed at runtime with admin PUT /log-level")
+
+	dnsRate  = flag.Int("dns-rate", 0, "Maximum uncached dns lookups per second, 0 to disable")
+	dnsQueue = flag.Int("dns-queue", 100, "Maximum dns lookups waiting for -dns-rate, lookups beyond fail with 503")
+
+	mirrorWorkers   = flag.Int("mirror-workers", 8, "Number of workers sending mirrored requests")
+	mirrorQueueSize = flag.Int("mirror-queue", 1000, "Maximum mirrored requests waiting for workers, requests beyond are dropped")
+
+	auditLogFile = flag.String("audit-log", "", "Destination of access control decision log in json (stderr, stdout, or file path), empty to disable")
+
+	forwardProxy         = flag.String("forward-proxy", "", "Comma separated parent http proxies [user:pass@]host:port[=weight] to use as default route with weighted round robin")
+	forwardProxyCooldown = flag.Duration("forward-proxy-cooldown", 30*time.Second, "Duration to skip parent proxy of -forward-proxy after connection error")
+
+	overrideUserAgent = flag.String("override-user-agent", "", "Replace User-Agent of forwarded http requests, - to remove, empty to keep client's")
+
+	maxTunnels = flag.Int("max-tunnels", 0, "Maximum concurrent CONNECT tunnels, new tunnels beyond get 503, 0 for unlimited")
+
+	acceptAuthorizationHeader = flag.Bool("accept-authorization-header", false, "Also accept -token as Bearer in Authorization header for clients that can not set Proxy-Authorization, header is removed before forwarding")
+
+	authFailMode = flag.String("auth-fail-mode", "closed", "Decision when auth backend (ldap) is unavailable, closed to deny with 503, open to admit as anonymous with unverified identity in log")
+
+	perTunnelRate = flag.Int("per-tunnel-rate", 0, "Maximum bytes per second of each CONNECT tunnel in each direction, 0 for unlimited")
+
+	destinationMetrics = flag.Bool("destination-metrics", false, "Count requests by requested host and effective host after -upstream-override in metrics, labels grow with number of destination hosts")
 )
 
 func main() {
 	flag.Parse()
 
+	if err := setupLogger(); err != nil {
+		slog.Error("setup logger error", "error", err)
+		os.Exit(1)
+	}
+	if err := setupAuditLog(); err != nil {
+		slog.Error("setup audit log error", "error", err)
+		os.Exit(1)
+	}
+
+	if *serviceCmd != "" && *serviceCmd != "run" {
+		err := controlService(*serviceCmd)
+		if err != nil {
+			slog.Error("service error", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if envPort := os.Getenv("PORT"); envPort != "" {
 		*port = envPort
 	}
 
+	if *forwardProxy != "" {
+		if err := setupForwardProxy(splitList(*forwardProxy)); err != nil {
+			slog.Error("setup forward proxy error", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	cfg := new(config)
+	if *configFile != "" {
+		var err error
+		cfg, err = loadConfig(*configFile)
+		if err != nil {
+			slog.Error("load config error", "error", err)
+			os.Exit(1)
+		}
+		err = setupRoutes(cfg)
+		if err != nil {
+			slog.Error("setup routes error", "error", err)
+			os.Exit(1)
+		}
+		err = setupUsers(cfg)
+		if err != nil {
+			slog.Error("setup users error", "error", err)
+			os.Exit(1)
+		}
+		err = setupTenants(cfg)
+		if err != nil {
+			slog.Error("setup tenants error", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *bindIP != "" {
+		if err := setupBindIPs(splitList(*bindIP)); err != nil {
+			slog.Error("setup bind ip error", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *allowExitHeader {
+		if err := setupExits(cfg); err != nil {
+			slog.Error("setup exits error", "error", err)
+			os.Exit(1)
+		}
+		if len(exits) == 0 {
+			slog.Error("allow exit header requires exits in config")
+			os.Exit(1)
+		}
+	}
+	if *mirrorURL != "" {
+		var err error
+		mirrorTarget, err = url.Parse(*mirrorURL)
+		if err != nil || (mirrorTarget.Scheme != "http" && mirrorTarget.Scheme != "https") || mirrorTarget.Host == "" {
+			slog.Error("invalid mirror url", "url", *mirrorURL)
+			os.Exit(1)
+		}
+		if *mirrorWorkers <= 0 || *mirrorQueueSize < 0 {
+			slog.Error("mirror workers must be positive and mirror queue must not be negative")
+			os.Exit(1)
+		}
+		startMirrorWorkers(*mirrorWorkers, *mirrorQueueSize)
+	}
+	if *tunnelBufferSize <= 0 {
+		slog.Error("tunnel buffer size must be positive")
+		os.Exit(1)
+	}
+	if *recordDir != "" && *replayDir != "" {
+		slog.Error("record dir and replay dir can not be used together")
+		os.Exit(1)
+	}
+	if *recordDir != "" {
+		if err := os.MkdirAll(*recordDir, 0755); err != nil {
+			slog.Error("create record dir error", "error", err)
+			os.Exit(1)
+		}
+		slog.Warn("recording http responses, not for production", "dir", *recordDir)
+	}
+	if *replayDir != "" {
+		slog.Warn("replaying recorded http responses, upstream is not used", "dir", *replayDir)
+	}
+	if *shutdownTimeout <= 0 {
+		slog.Error("shutdown timeout must be positive")
+		os.Exit(1)
+	}
+
+	for _, eg := range egresses {
+		eg.Transport.TLSHandshakeTimeout = *tlsHandshakeTimeout
+	}
+	if *insecureUpstream {
+		slog.Warn("upstream tls certificate verification is disabled, do not use in production")
+		for _, eg := range egresses {
+			eg.Transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+	}
+	if *ldapURL != "" {
+		err := setupLDAP(cfg)
+		if err != nil {
+			slog.Error("setup ldap error", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *authUser != "" && *authPass != "" {
+		users[*authUser] = &user{
+			Name:     *authUser,
+			Password: *authPass,
+		}
+	}
+
+	if err := parseLogExclude(splitList(*logExclude)); err != nil {
+		slog.Error("parse log exclude error", "error", err)
+		os.Exit(1)
+	}
+
+	if err := parseUpstreamOverrides(splitList(*upstreamOverride)); err != nil {
+		slog.Error("parse upstream override error", "error", err)
+		os.Exit(1)
+	}
+
+	if *trustForwarded != "" {
+		var err error
+		trustedForwarders, err = parseCIDRs(splitList(*trustForwarded))
+		if err != nil {
+			slog.Error("parse trust forwarded error", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	stripHeaders = splitList(*stripHeader)
+	allowHosts = splitList(*allowHost)
+	denyHosts = splitList(*denyHost)
+	httpsOnlyHosts = splitList(*httpsOnlyHost)
+	if *connectTLSOnly {
+		if err := parseConnectPorts(splitList(*connectTLSPorts)); err != nil {
+			slog.Error("parse connect tls ports error", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *allowCIDR != "" || *denyCIDR != "" {
+		var err error
+		allowCIDRs, err = parseCIDRs(splitList(*allowCIDR))
+		if err != nil {
+			slog.Error("parse allow cidr error", "error", err)
+			os.Exit(1)
+		}
+		denyCIDRs, err = parseCIDRs(splitList(*denyCIDR))
+		if err != nil {
+			slog.Error("parse deny cidr error", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *geoipFile != "" {
+		err := openGeoIP(*geoipFile)
+		if err != nil {
+			slog.Error("open geoip database error", "error", err)
+			os.Exit(1)
+		}
+		allowCountries = parseCountries(*allowCountry)
+		denyCountries = parseCountries(*denyCountry)
+	}
+	warnIPRulesThroughParent()
+
+	if *authFailMode != "closed" && *authFailMode != "open" {
+		slog.Error("invalid auth fail mode", "mode", *authFailMode)
+		os.Exit(1)
+	}
+	if *authFailMode == "open" {
+		slog.Warn("auth fail mode is open, requests are admitted without verified credentials when auth backend is unavailable")
+	}
+	if *errorFormat != "text" && *errorFormat != "json" {
+		slog.Error("invalid error format", "format", *errorFormat)
+		os.Exit(1)
+	}
+
+	if *hostIdleTimeout != "" {
+		if err := parseHostIdleTimeouts(splitList(*hostIdleTimeout)); err != nil {
+			slog.Error("parse host idle timeout error", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *methodTimeout != "" {
+		var err error
+		methodTimeouts, err = parseMethodTimeouts(splitList(*methodTimeout))
+		if err != nil {
+			slog.Error("parse method timeout error", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *rewriteStatusRules != "" {
+		var err error
+		statusRewrites, err = parseStatusRewrites(*rewriteStatusRules)
+		if err != nil {
+			slog.Error("parse rewrite status error", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	srv := parapet.New()
 	srv.Addr = ":" + *port
 	srv.Handler = http.HandlerFunc(proxy)
+	srv.H2C = *enableH2C
+	srv.WaitBeforeShutdown = *predrainDelay
+	srv.GraceTimeout = *shutdownTimeout
+	srv.RegisterOnShutdown(drain)
+	if *acceptRate > 0 {
+		modifyConnection(srv, newAcceptLimiter(*acceptRate, *acceptBurst).ModifyConnection)
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		if err := setupTLS(srv); err != nil {
+			slog.Error("setup tls error", "error", err)
+			os.Exit(1)
+		}
+	}
 
+	srv.Use(rejectDirectTrace())
+	srv.Use(parapet.Cond{
+		If:   isDirect,
+		Then: hz,
+	})
+	if *landingPageFile != "" {
+		if *transparent {
+			slog.Error("landing page can not be used with transparent mode")
+			os.Exit(1)
+		}
+		body, err := os.ReadFile(*landingPageFile)
+		if err != nil {
+			slog.Error("read landing page error", "error", err)
+			os.Exit(1)
+		}
+		srv.Use(landingPage(body))
+	}
+	if *readinessProbe != "" {
+		target, err := url.Parse(*readinessProbe)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			slog.Error("invalid readiness probe url", "url", *readinessProbe)
+			os.Exit(1)
+		}
+		go probeReadiness(target)
+	}
+
+	tarpitSlots = make(chan struct{}, max(*tarpitMax, 0))
+
+	if breaker.enabled() {
+		go breaker.cleanupLoop()
+	}
+	if resolver.enabled() {
+		go resolver.cleanupLoop()
+	}
+	if *idlePruneInterval > 0 {
+		go pruneIdleLoop(*idlePruneInterval)
+	}
+	go dumpTunnelsLoop()
+	if *pushgatewayURL != "" {
+		if *pushgatewayInterval <= 0 {
+			slog.Error("pushgateway interval must be positive")
+			os.Exit(1)
+		}
+		go pushMetricsLoop(*pushgatewayURL, *pushgatewayInterval)
+	}
+
+	var auths multiAuthenticator
 	if *token != "" {
-		srv.Use(authn.Authenticator{
-			Type: "Bearer",
-			Authenticate: func(req *http.Request) error {
-				// TODO: change to Proxy-Authorization but breaking change
-				reqToken := req.Header.Get("Proxy-Authorization")
-				req.Header.Del("Proxy-Authorization")
-				if subtle.ConstantTimeCompare([]byte(reqToken), []byte(*token)) != 1 {
-					return authn.ErrInvalidCredentials
-				}
-				return nil
-			},
-		})
+		auths = append(auths, tokenAuthenticator{Token: *token})
 	}
-	if *authUser != "" && *authPass != "" {
-		authStr := base64.StdEncoding.EncodeToString([]byte(*authUser + ":" + *authPass))
-		srv.Use(authn.Authenticator{
-			Type: "Basic",
-			Authenticate: func(req *http.Request) error {
-				auth := req.Header.Get("Proxy-Authorization")
-				req.Header.Del("Proxy-Authorization")
-
-				const prefix = "Basic "
-				if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
-					return authn.ErrInvalidCredentials
-				}
-				if subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(authStr)) != 1 {
-					return authn.ErrInvalidCredentials
-				}
-				return nil
+	if len(users) > 0 {
+		auths = append(auths, basicAuthenticator{Users: users})
+	}
+	if ldapAuth != nil {
+		auths = append(auths, ldapAuth)
+	}
+	if len(auths) > 0 {
+		srv.Use(authenticate(auths))
+	}
+	if len(tenants) > 0 {
+		srv.Use(selectTenant(len(auths) > 0))
+	}
+	if *allowExitHeader {
+		srv.Use(selectExit())
+	}
+
+	if *enableCompress {
+		srv.Use(parapet.Cond{
+			If: func(r *http.Request) bool {
+				return r.Method != http.MethodConnect && !isDirect(r)
 			},
+			Then: compress.Gzip(),
 		})
 	}
 
+	if *adminAddr != "" {
+		if !adminAuthConfigured() {
+			slog.Error("admin server requires -admin-token, -token or -auth-user and -auth-pass")
+			os.Exit(1)
+		}
+		go func() {
+			slog.Info("admin", "addr", *adminAddr)
+			err := (&http.Server{
+				Addr:              *adminAddr,
+				Handler:           adminHandler(),
+				ReadHeaderTimeout: 10 * time.Second,
+			}).ListenAndServe()
+			if err != nil {
+				slog.Error("start admin server error", "error", err)
+			}
+		}()
+	}
+
 	slog.Info("httpproxy",
 		"port", *port,
 	)
-	err := srv.ListenAndServe()
+	if *serviceCmd == "run" || isService() {
+		err := runService(srv)
+		if err != nil {
+			slog.Error("run service error", "error", err)
+		}
+		logSummary()
+		return
+	}
+	err := listenAndServe(srv)
 	if err != nil {
 		slog.Error("start server error", "error", err)
 	}
+	// server shutdown does not track hijacked connections,
+	// tunnels get the same grace period after http requests are drained
+	tunnels.Shutdown(*shutdownTimeout)
+	logSummary()
+}
+
+// unauthorized responds to failed authentication,
+// missing credentials are challenged with each scheme so interactive clients prompt,
+// invalid credentials are rejected without challenge to avoid prompt loop
+func unauthorized(w http.ResponseWriter, r *http.Request, schemes []string, err error) {
+	if errors.Is(err, authn.ErrMissingAuthorization) || *authRechallenge {
+		for _, s := range schemes {
+			if s == "Basic" {
+				s += ` realm="httpproxy"`
+			}
+			w.Header().Add("Proxy-Authenticate", s)
+			w.Header().Add("WWW-Authenticate", s)
+		}
+		proxyError(w, r, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+	if tarpit(w, r) {
+		return
+	}
+	proxyError(w, r, "Invalid Credentials", http.StatusProxyAuthRequired)
+}
+
+// isDirect reports whether request is sent to proxy itself
+func isDirect(r *http.Request) bool {
+	return r.Method != http.MethodConnect && strings.HasPrefix(r.RequestURI, "/")
+}
+
+// rejectDirectTrace returns middleware that rejects TRACE to proxy's own endpoints with 405,
+// TRACE through proxy is forwarded to upstream,
+// in transparent mode origin-form requests are proxied so TRACE is forwarded too
+func rejectDirectTrace() parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodTrace && isDirect(r) && !*transparent {
+				w.Header().Set("Allow", "GET, HEAD")
+				proxyError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
 }
 
 func proxy(w http.ResponseWriter, r *http.Request) {
+	if *maxURILength > 0 && len(r.RequestURI) > *maxURILength {
+		proxyError(w, r, "URI Too Long", http.StatusRequestURITooLong)
+		return
+	}
+
 	if r.Method == http.MethodConnect {
 		handleTunnel(w, r)
 		return
@@ -88,98 +627,730 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 	handleHTTP(w, r)
 }
 
-var dialer = net.Dialer{
-	Timeout:   10 * time.Second,
-	KeepAlive: 15 * time.Second,
-}
-
 func handleTunnel(w http.ResponseWriter, r *http.Request) {
-	if *enableLog {
-		slog.Info("tunnel connect", "addr", r.RequestURI)
+	intendedHost := connectHost(r)
+	r.RequestURI = unescapeZone(r.RequestURI)
+
+	if logEnabled(r) {
+		args := []any{"addr", r.RequestURI, "user", logIdentity(r)}
+		if intendedHost != "" {
+			args = append(args, "connect_host", intendedHost)
+		}
+		if ja3 := requestJA3(r); ja3 != "" {
+			args = append(args, "ja3", ja3)
+		}
+		args = append(args, tlsLogArgs(r)...)
+		accessLog.Info("tunnel connect", args...)
+	}
+
+	host, _, err := net.SplitHostPort(r.RequestURI)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(r.RequestURI, "["), "]")
+		if *defaultConnectPort == "" || !validHostname(host) {
+			proxyError(w, r, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		r.RequestURI = net.JoinHostPort(host, *defaultConnectPort)
+		r.Host = r.RequestURI
+	}
+	if !connectPortAllowed(r.RequestURI) {
+		audit(r, r.RequestURI, "connect-port", false)
+		forbidden(w, r)
+		return
+	}
+	// intended host is not verified to resolve to target ip,
+	// so it can only deny, allow rules are evaluated on target
+	if intendedHost != "" && matchHosts(denyHosts, intendedHost) {
+		audit(r, intendedHost, "deny-host", false)
+		forbidden(w, r)
+		return
+	}
+	if !hostAllowed(r, host) {
+		forbidden(w, r)
+		return
+	}
+
+	// HTTP/1 tunnel needs to hijack connection, check before dialing upstream
+	hijacker, ok := w.(http.Hijacker)
+	if r.ProtoMajor != 2 && !ok {
+		hijackFailures.WithLabelValues("unsupported").Inc()
+		slog.Error("hijack not supported", "addr", r.RequestURI, "proto", r.Proto)
+		proxyError(w, r, "Hijack not supported", http.StatusInternalServerError)
+		return
+	}
+
+	if !tunnels.Acquire() {
+		slog.Warn("max tunnels reached", "addr", r.RequestURI, "max", *maxTunnels)
+		proxyError(w, r, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer tunnels.Release()
+	if !inflight.Acquire(host) {
+		proxyError(w, r, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer inflight.Release(host)
+
+	eg := selectEgress(r, host)
+
+	if !breaker.Allow(host) {
+		proxyError(w, r, "Service Unavailable", http.StatusServiceUnavailable)
+		return
 	}
 
-	upstream, err := dialer.DialContext(r.Context(), "tcp", r.RequestURI)
+	dialAddr := overrideAddr(r.RequestURI)
+	upstream, err := eg.Dial(r.Context(), "tcp", dialAddr)
+	if errors.Is(err, errDestinationDenied) {
+		breaker.Done(host)
+		audit(r, r.RequestURI, "ip", false)
+		forbidden(w, r)
+		return
+	}
+	if errors.Is(err, errDNSRateLimited) {
+		breaker.Done(host)
+		slog.Warn("dns rate limited", "addr", r.RequestURI)
+		proxyError(w, r, "DNS Rate Limited", http.StatusServiceUnavailable)
+		return
+	}
+	var parentErr *parentProxyError
+	if errors.As(err, &parentErr) {
+		if parentErr.StatusCode >= 500 {
+			breaker.Failure(host)
+		} else {
+			breaker.Done(host)
+		}
+		slog.Error("parent proxy error", "addr", r.RequestURI, "egress", eg.Name, "status", parentErr.StatusCode)
+		if parentErr.passAuthChallenge() {
+			for _, v := range parentErr.Header.Values("Proxy-Authenticate") {
+				w.Header().Add("Proxy-Authenticate", v)
+			}
+		}
+		proxyError(w, r, err.Error(), parentErr.clientStatus())
+		return
+	}
+	if err != nil && r.Context().Err() != nil {
+		// client went away, dial result does not tell host health
+		breaker.Done(host)
+		return
+	}
 	if err != nil {
-		slog.Error("dial upstream error", "network", "tcp", "addr", r.RequestURI, "error", err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		breaker.Failure(host)
+		slog.Error("dial upstream error", "network", "tcp", "addr", r.RequestURI, "egress", eg.Name, "error", err)
+		proxyError(w, r, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 	defer upstream.Close()
+	breaker.Success(host)
+	countDestination(host, dialAddr, eg.Name)
+	tuneConn(upstream)
+
+	// upstream may close right after dial, do not establish half-dead tunnel
+	if err := peekClosed(upstream); err != nil {
+		slog.Error("upstream closed before tunnel established", "addr", r.RequestURI, "egress", eg.Name, "error", err)
+		proxyError(w, r, "Upstream closed", http.StatusBadGateway)
+		return
+	}
+
+	// HTTP/2 CONNECT runs on a stream, not on the connection
+	if r.ProtoMajor == 2 {
+		if v := debugIdentity(r); v != "" {
+			w.Header().Set(*debugIdentityHeader, v)
+		}
+		w.WriteHeader(http.StatusOK)
+		client := newStreamConn(w, r)
+		if err := client.rc.Flush(); err != nil {
+			slog.Error("flush stream error", "addr", r.RequestURI, "error", err)
+			return
+		}
+		defer client.Close()
+
+		splice(r, eg, upstream, client)
+		return
+	}
 
-	client, wr, err := w.(http.Hijacker).Hijack()
+	client, wr, err := hijacker.Hijack()
 	if err != nil {
-		slog.Error("hijack error", "addr", r.RequestURI, "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		hijackFailures.WithLabelValues("error").Inc()
+		slog.Error("hijack error", "addr", r.RequestURI, "proto", r.Proto, "error", err)
+		proxyError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer client.Close()
+	tuneConn(client)
 
-	wr.WriteString("HTTP/1.1 200 OK\n\n")
+	wr.WriteString("HTTP/1.1 200 OK\n")
+	if v := debugIdentity(r); v != "" && httpguts.ValidHeaderFieldValue(v) {
+		wr.WriteString(*debugIdentityHeader + ": " + v + "\n")
+	}
+	wr.WriteString("\n")
 	wr.Flush()
 
-	errc := make(chan error, 1)
+	splice(r, eg, upstream, client)
+}
+
+func splice(r *http.Request, eg *egress, upstream, client net.Conn) {
+	t := &tunnel{
+		ClientIP: clientIP(r),
+		Target:   r.RequestURI,
+		Egress:   eg.Name,
+		Start:    time.Now(),
+		upstream: upstream,
+		client:   client,
+	}
+	tunnels.Add(t)
+	defer tunnels.Remove(t)
+	host := targetHost(r)
+	limiter := hostRates.Acquire(host)
+	defer hostRates.Release(host)
+	stats.Tunnels.Add(1)
+	defer func() {
+		stats.BytesIn.Add(t.BytesIn.Load())
+		stats.BytesOut.Add(t.BytesOut.Load())
+	}()
+
+	errc := make(chan error, 2)
 	c := conCopier{
-		src: upstream,
-		dst: client,
+		src:        upstream,
+		dst:        client,
+		tunnel:     t,
+		limiter:    limiter,
+		inLimiter:  newByteLimiter(*perTunnelRate),
+		outLimiter: newByteLimiter(*perTunnelRate),
+	}
+	if *connectFirstByteTimeout > 0 {
+		c.src = newFirstByteConn(upstream, *connectFirstByteTimeout)
+	}
+	if *logSNI && logEnabled(r) {
+		c.dst = &helloSniffConn{
+			Conn: client,
+			onDone: func(hello clientHello, ok bool) {
+				if !ok {
+					return
+				}
+				accessLog.Info("tunnel tls", "addr", r.RequestURI, "sni", hello.ServerName, "alpn", hello.ALPN, "ja3", hello.JA3Hash())
+			},
+		}
 	}
 	go c.copyToDst(errc)
 	go c.copyToSrc(errc)
-	<-errc
 
-	if *enableLog {
-		slog.Info("tunnel closed", "addr", r.RequestURI)
+	// close tunnel when request canceled
+	var canceled atomic.Bool
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			canceled.Store(true)
+			t.Close()
+		case <-done:
+		}
+	}()
+
+	err := <-errc
+	end := err.(*copyEnd)
+	pending := 1
+	if errors.Is(err, errHalfClosed) {
+		// wait for other direction to finish
+		err = <-errc
+		pending = 0
+	}
+	if fc, ok := c.src.(*firstByteConn); ok && !fc.received.Load() && errors.Is(err, os.ErrDeadlineExceeded) {
+		slog.Info("tunnel first byte timeout", "addr", r.RequestURI, "timeout", *connectFirstByteTimeout)
+	}
+
+	// unblock the other direction, stream writer must not be used after handler returns
+	upstream.Close()
+	client.Close()
+	if pending > 0 {
+		<-errc
+	}
+
+	if logEnabled(r) {
+		reason := end.Reason()
+		if canceled.Load() {
+			reason = "canceled"
+		}
+		args := []any{
+			"addr", r.RequestURI,
+			"egress", t.Egress,
+		}
+		if dialAddr := overrideAddr(r.RequestURI); dialAddr != r.RequestURI {
+			args = append(args, "override_addr", dialAddr)
+		}
+		args = append(args,
+			"upstream_addr", upstream.RemoteAddr().String(),
+			"local_addr", upstream.LocalAddr().String(),
+			"close_reason", reason,
+		)
+		if end.Err != nil && !errors.Is(end.Err, errHalfClosed) {
+			args = append(args, "error", end.Err)
+		}
+		accessLog.Info("tunnel closed", args...)
 	}
 }
 
 type conCopier struct {
-	src net.Conn
-	dst net.Conn
+	src     net.Conn
+	dst     net.Conn
+	tunnel  *tunnel
+	limiter *byteLimiter // per host, nil for unlimited
+
+	// per tunnel for each direction, nil for unlimited
+	inLimiter  *byteLimiter
+	outLimiter *byteLimiter
 }
 
+// copy functions write each read immediately without coalescing,
+// buffer size only limits the size of a single write
+
 func (c *conCopier) copyToDst(errc chan error) {
-	_, err := io.Copy(c.src, c.dst)
-	errc <- err
+	w := &countWriter{w: limitWriter(limitWriter(c.src, c.limiter), c.inLimiter), n: &c.tunnel.BytesIn}
+	_, err := io.CopyBuffer(w, c.dst, make([]byte, *tunnelBufferSize))
+	end := newCopyEnd("client", "upstream", w, err)
+	if err == nil && *allowHalfClose && closeWrite(c.tunnel.upstream) {
+		end.Err = errHalfClosed
+	}
+	errc <- end
 }
 
 func (c *conCopier) copyToSrc(errc chan error) {
-	_, err := io.Copy(c.dst, c.src)
-	errc <- err
-}
-
-var httpTransport = upstream.HTTPTransport{
-	DialTimeout:     5 * time.Second,
-	TCPKeepAlive:    10 * time.Second,
-	MaxIdleConns:    1000,
-	IdleConnTimeout: 1 * time.Minute,
+	w := &countWriter{w: limitWriter(limitWriter(c.dst, c.limiter), c.outLimiter), n: &c.tunnel.BytesOut}
+	_, err := io.CopyBuffer(w, c.src, make([]byte, *tunnelBufferSize))
+	end := newCopyEnd("upstream", "client", w, err)
+	if err == nil && *allowHalfClose && closeWrite(c.tunnel.client) {
+		end.Err = errHalfClosed
+	}
+	errc <- end
 }
 
 func handleHTTP(w http.ResponseWriter, r *http.Request) {
-	if *enableLog {
-		slog.Info("http", "method", r.Method, "host", r.Host, "path", r.URL.Path)
+	stats.Requests.Add(1)
+	body := &countReadCloser{ReadCloser: r.Body}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = body
 	}
+	defer func() { stats.BytesIn.Add(body.n.Load()) }()
+
+	if logEnabled(r) {
+		lw := &logResponseWriter{ResponseWriter: w}
+		w = lw
 
-	if !strings.HasPrefix(r.RequestURI, "http://") {
+		method, host, path, user, ja3 := r.Method, r.Host, r.URL.Path, logIdentity(r), requestJA3(r)
+		tlsArgs := tlsLogArgs(r)
+		var upstream *upstreamInfo
+		r, upstream = withUpstreamInfo(r)
+		start := time.Now()
+		defer func() {
+			args := []any{
+				"method", method,
+				"host", host,
+				"path", path,
+				"user", user,
+				"status", lw.status,
+				"bytes_in", body.n.Load(),
+				"bytes_out", lw.written,
+				"duration", time.Since(start),
+			}
+			if ja3 != "" {
+				args = append(args, "ja3", ja3)
+			}
+			args = append(args, tlsArgs...)
+			args = append(args, upstream.logArgs()...)
+			accessLog.Info("http", args...)
+		}()
+	}
+
+	if *strictHost && !strictHostValid(r) {
+		proxyError(w, r, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if *transparent && strings.HasPrefix(r.RequestURI, "/") {
+		if !transparentTarget(r) {
+			proxyError(w, r, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	} else if !strings.HasPrefix(r.RequestURI, "http://") {
 		http.NotFound(w, r)
 		return
 	}
 
-	// remove headers
-	r.Header.Del("X-Real-Ip")
-	r.Header.Del("X-Forwarded-For")
-	r.Header.Del("X-Forwarded-Proto")
+	if !hostAllowed(r, r.URL.Hostname()) || plainHTTPDenied(r, r.URL) {
+		forbidden(w, r)
+		return
+	}
+
+	dstHost := r.URL.Hostname()
+	if !inflight.Acquire(dstHost) {
+		proxyError(w, r, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer inflight.Release(dstHost)
+	limiter := hostRates.Acquire(dstHost)
+	defer hostRates.Release(dstHost)
 
-	resp, err := httpTransport.RoundTrip(r)
+	for _, h := range stripHeaders {
+		r.Header.Del(h)
+	}
+
+	// Proxy-Connection is non-standard hop-by-hop header of old clients,
+	// only close can be honored since server decided keep-alive when reading request
+	if httpguts.HeaderValuesContainsToken(r.Header.Values("Proxy-Connection"), "close") {
+		w.Header().Set("Connection", "close")
+	}
+	r.Header.Del("Proxy-Connection")
+
+	switch *overrideUserAgent {
+	case "":
+	case "-":
+		// empty value stops transport from sending its default
+		r.Header.Set("User-Agent", "")
+	default:
+		r.Header.Set("User-Agent", *overrideUserAgent)
+	}
+
+	timeout := requestTimeout(r)
+	r.Header.Del("X-Proxy-Timeout")
+
+	if mirrorTarget != nil {
+		defer newMirror(r).send()
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, cancel)
+	}
+	var totalTimer *time.Timer
+	var totalExpired atomic.Bool
+	if *httpTotalTimeout > 0 {
+		totalTimer = time.AfterFunc(*httpTotalTimeout, func() {
+			totalExpired.Store(true)
+			cancel()
+		})
+		defer totalTimer.Stop()
+	}
+	resp, err := roundTrip(r)
+	if err != nil && *retryIdempotent && retryable(r, err) {
+		resp, err = roundTrip(r)
+	}
+	for hop := 0; err == nil && hop < *followRedirects; hop++ {
+		next := redirectRequest(r, resp)
+		if next == nil || !hostAllowed(r, next.URL.Hostname()) || plainHTTPDenied(r, next.URL) {
+			break
+		}
+		if h := next.URL.Hostname(); h != dstHost {
+			// new destination is limited same as requested one
+			if !inflight.Acquire(h) {
+				break
+			}
+			defer inflight.Release(h)
+			limiter = hostRates.Acquire(h)
+			defer hostRates.Release(h)
+			dstHost = h
+		}
+		resp.Body.Close()
+		r = next
+		resp, err = roundTrip(r)
+	}
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		slog.Error("http round trip timeout", "host", r.Host, "timeout", timeout)
+		proxyError(w, r, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil && totalExpired.Load() {
+		slog.Error("http total timeout", "host", r.Host, "timeout", *httpTotalTimeout)
+		proxyError(w, r, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, errCircuitOpen) {
+		proxyError(w, r, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errDestinationDenied) {
+		audit(r, r.URL.Host, "ip", false)
+		forbidden(w, r)
+		return
+	}
+	if errors.Is(err, errDNSRateLimited) {
+		slog.Warn("dns rate limited", "host", r.Host)
+		proxyError(w, r, "DNS Rate Limited", http.StatusServiceUnavailable)
+		return
+	}
+	if isTLSHandshakeTimeout(err) {
+		slog.Error("http tls handshake timeout", "host", r.Host, "timeout", *tlsHandshakeTimeout)
+		proxyError(w, r, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, errNotRecorded) {
+		proxyError(w, r, "Response Not Recorded", http.StatusBadGateway)
+		return
+	}
 	if err != nil {
 		slog.Error("http round trip error", "host", r.Host, "error", err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		proxyError(w, r, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+
+	if n := headerCount(resp.Header); *maxResponseHeaders > 0 && n > *maxResponseHeaders {
+		slog.Error("too many response headers", "host", r.Host, "headers", n)
+		proxyError(w, r, "Bad Gateway", http.StatusBadGateway)
 		return
 	}
 
+	if totalTimer != nil && streamingResponse(resp) {
+		totalTimer.Stop()
+	}
+
+	replaceBody := rewriteStatus(resp)
+
 	for k, v := range resp.Header {
 		for _, vv := range v {
 			w.Header().Add(k, vv)
 		}
 	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	if replaceBody {
+		n, _ := io.WriteString(w, *rewriteStatusBody)
+		stats.BytesOut.Add(int64(n))
+		return
+	}
+	n, err := io.Copy(limitWriter(w, limiter), resp.Body)
+	stats.BytesOut.Add(n)
+	if err != nil && totalExpired.Load() {
+		slog.Error("http total timeout, response truncated", "host", r.Host, "timeout", *httpTotalTimeout, "bytes", n)
+	}
+}
+
+// strictHostValid reports whether http request has Host,
+// and Host matches host of absolute request uri
+func strictHostValid(r *http.Request) bool {
+	if r.Host == "" {
+		return false
+	}
+	return r.URL.Host == "" || strings.EqualFold(r.Host, r.URL.Host)
+}
+
+// streamingResponse reports whether response content type is exempted from -http-total-timeout
+func streamingResponse(resp *http.Response) bool {
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	for _, t := range splitList(*httpTotalTimeoutExempt) {
+		t = strings.ToLower(t)
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// roundTrip sends request to upstream through selected egress
+func roundTrip(r *http.Request) (*http.Response, error) {
+	if *replayDir != "" {
+		return replayResponse(r)
+	}
+
+	host := r.URL.Hostname()
+	if !breaker.Allow(host) {
+		return nil, errCircuitOpen
+	}
+
+	eg := selectEgress(r, host)
+	r = eg.withParent(r)
+	r = trackUpstream(r, eg)
+	if *parentXFF && eg.viaParent(r) {
+		r = withForwardedFor(r)
+	}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), connTrace))
+	resp, err := eg.transport(host).RoundTrip(r)
+	if errors.Is(err, errDestinationDenied) || errors.Is(err, errDNSRateLimited) || (err != nil && r.Context().Err() != nil) {
+		// cancelled by client or timeout does not tell host health
+		breaker.Done(host)
+		return nil, err
+	}
+	if err != nil {
+		breaker.Failure(host)
+		return nil, err
+	}
+	breaker.Success(host)
+	if eg.viaParent(r) {
+		countDestination(host, "", eg.Name)
+	} else {
+		countDestination(host, overrideAddr(urlAddr(r.URL)), eg.Name)
+	}
+	if *recordDir != "" {
+		recordResponse(r, resp)
+	}
+	return resp, nil
+}
+
+// headerCount returns number of header fields
+func headerCount(h http.Header) int {
+	n := 0
+	for _, v := range h {
+		n += len(v)
+	}
+	return n
+}
+
+// isTLSHandshakeTimeout reports whether err is upstream TLS handshake timeout,
+// transport does not export the error type
+func isTLSHandshakeTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout() && strings.Contains(err.Error(), "TLS handshake timeout")
+}
+
+// retryable reports whether failed request can be sent again,
+// only idempotent request without body that failed at connection level
+func retryable(r *http.Request, err error) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	if r.ContentLength != 0 || r.Context().Err() != nil {
+		return false
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// redirectRequest returns request to follow http redirect response,
+// or nil if response should be returned to client
+func redirectRequest(r *http.Request, resp *http.Response) *http.Request {
+	method := r.Method
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if method != http.MethodGet && method != http.MethodHead {
+			method = http.MethodGet
+		}
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		// body already consumed, can not resend
+		if r.ContentLength != 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	loc, err := resp.Location()
+	if err != nil || loc.Scheme != "http" {
+		return nil
+	}
+
+	next := r.Clone(r.Context())
+	next.Method = method
+	next.URL = loc
+	next.Host = loc.Host
+	next.RequestURI = loc.String()
+	if loc.Host != r.URL.Host {
+		// credentials are for original host only
+		for _, h := range []string{"Authorization", "Www-Authenticate", "Cookie", "Cookie2", "Proxy-Authorization"} {
+			next.Header.Del(h)
+		}
+	}
+	if method != r.Method {
+		next.Body = http.NoBody
+		next.ContentLength = 0
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	}
+	return next
+}
+
+// defaultHTTPTimeout is round trip timeout when -http-timeout is not set,
+// transport has no response header timeout so per request timeouts can be longer
+const defaultHTTPTimeout = 1 * time.Minute
+
+// requestTimeout returns round trip timeout for the request
+func requestTimeout(r *http.Request) time.Duration {
+	timeout := *httpTimeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	if d, ok := methodTimeouts[r.Method]; ok {
+		timeout = d
+	}
+	if !*allowTimeoutHeader {
+		return timeout
+	}
+
+	v := r.Header.Get("X-Proxy-Timeout")
+	if v == "" {
+		return timeout
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		// allow plain seconds
+		sec, err := strconv.Atoi(v)
+		if err != nil {
+			return timeout
+		}
+		d = time.Duration(sec) * time.Second
+	}
+	if d <= 0 {
+		return timeout
+	}
+	return min(d, *maxTimeoutHeader)
+}
+
+// stripHeaders are removed from http request before forwarding
+var stripHeaders []string
+
+// methodTimeouts overrides -http-timeout by request method
+var methodTimeouts map[string]time.Duration
+
+// parseMethodTimeouts parses METHOD=duration list
+func parseMethodTimeouts(list []string) (map[string]time.Duration, error) {
+	m := make(map[string]time.Duration)
+	for _, p := range list {
+		method, v, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid method timeout %s", p)
+		}
+		method = strings.ToUpper(strings.TrimSpace(method))
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+			http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		default:
+			return nil, fmt.Errorf("invalid method timeout %s: unknown method", p)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid method timeout %s", p)
+		}
+		m[method] = d
+	}
+	return m, nil
+}
+
+// splitList splits comma separated list, ignores empty items
+func splitList(s string) []string {
+	var xs []string
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if x != "" {
+			xs = append(xs, x)
+		}
+	}
+	return xs
 }
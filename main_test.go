@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startProxy starts proxy on ephemeral loopback port, returns its url
+func startProxy(tb testing.TB) *url.URL {
+	tb.Helper()
+	var wg sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		proxy(w, r)
+	}))
+	tb.Cleanup(func() {
+		srv.Close()
+
+		// server does not wait for hijacked tunnels,
+		// handlers must finish before next test changes flags
+		for _, t := range tunnels.List() {
+			t.Close()
+		}
+		wg.Wait()
+	})
+	u, _ := url.Parse(srv.URL)
+	return u
+}
+
+// proxyClient returns http client sending requests through proxy
+func proxyClient(proxyURL *url.URL) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyURL(proxyURL),
+			MaxIdleConnsPerHost: 100,
+			DisableCompression:  true,
+		},
+	}
+}
+
+// startTCPUpstream starts tcp server on ephemeral loopback port serving each connection with h,
+// returns its address
+func startTCPUpstream(tb testing.TB, h func(conn net.Conn)) string {
+	tb.Helper()
+	return startTCPUpstreamAddr(tb, "127.0.0.1:0", h)
+}
+
+// startTCPUpstreamAddr starts tcp server listening on addr serving each connection with h,
+// returns its address
+func startTCPUpstreamAddr(tb testing.TB, addr string, h func(conn net.Conn)) string {
+	tb.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				h(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialTunnel opens CONNECT tunnel through proxy to target,
+// returns response status code and tunnel connection
+func dialTunnel(tb testing.TB, proxyURL *url.URL, target string) (int, net.Conn) {
+	tb.Helper()
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	resp.Body.Close()
+	if br.Buffered() > 0 {
+		tb.Fatal("unexpected data after CONNECT response")
+	}
+	return resp.StatusCode, conn
+}
+
+// sizeServer writes requested number of bytes for each 8 bytes big endian size read
+func sizeServer(conn net.Conn) {
+	buf := make([]byte, 32*1024)
+	var size [8]byte
+	for {
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		for n := int64(binary.BigEndian.Uint64(size[:])); n > 0; {
+			m := min(n, int64(len(buf)))
+			if _, err := conn.Write(buf[:m]); err != nil {
+				return
+			}
+			n -= m
+		}
+	}
+}
+
+func TestConnectWithoutHijacker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conns = append(conns, conn)
+		}
+	}()
+
+	// recorder does not implement http.Hijacker
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodConnect, ln.Addr().String(), nil)
+	handleTunnel(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := accepted.Load(); n != 0 {
+		t.Errorf("expected no upstream dial, got %d connections", n)
+	}
+}
+
+// BenchmarkTunnelPingPong measures round trip latency of small messages over tunnel,
+// copy path must not buffer or coalesce latency sensitive bidirectional streams
+func BenchmarkTunnelPingPong(b *testing.B) {
+	target := startTCPUpstream(b, func(conn net.Conn) { io.Copy(conn, conn) })
+	code, conn := dialTunnel(b, startProxy(b), target)
+	if code != http.StatusOK {
+		b.Fatalf("expected 200, got %d", code)
+	}
+
+	msg := []byte("ping")
+	buf := make([]byte, len(msg))
+	b.ResetTimer()
+	for range b.N {
+		conn.Write(msg)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHTTPThroughProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	resp, err := proxyClient(startProxy(t)).Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestTunnelThroughProxy(t *testing.T) {
+	target := startTCPUpstream(t, func(conn net.Conn) { io.Copy(conn, conn) })
+
+	code, conn := dialTunnel(t, startProxy(t), target)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("unexpected echo %q: %v", buf, err)
+	}
+}
+
+func BenchmarkHTTPLatency(b *testing.B) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	client := proxyClient(startProxy(b))
+
+	b.ResetTimer()
+	for range b.N {
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+func BenchmarkHTTPThroughput(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer upstream.Close()
+	client := proxyClient(startProxy(b))
+
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for range b.N {
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+func BenchmarkTunnelThroughput(b *testing.B) {
+	const chunk = 1 << 20
+	target := startTCPUpstream(b, sizeServer)
+	code, conn := dialTunnel(b, startProxy(b), target)
+	if code != http.StatusOK {
+		b.Fatalf("expected 200, got %d", code)
+	}
+
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], chunk)
+	b.SetBytes(chunk)
+	b.ResetTimer()
+	for range b.N {
+		conn.Write(size[:])
+		if _, err := io.CopyN(io.Discard, conn, chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestConnectUpstreamClosedAfterDial(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	target := startTCPUpstream(t, func(conn net.Conn) {
+		conn.Close()
+		closed <- struct{}{}
+	})
+
+	// dial returns only after upstream closed the accepted connection
+	route := defaultRoute
+	defaultRoute = &egress{
+		Name: "test",
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, addr)
+			if err == nil {
+				<-closed
+			}
+			return conn, err
+		},
+		Transport: httpTransport,
+	}
+	t.Cleanup(func() { defaultRoute = route })
+
+	code, _ := dialTunnel(t, startProxy(t), target)
+	if code != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", code)
+	}
+}
+
+func TestRequestTimeoutLongerThanDefault(t *testing.T) {
+	methodTimeouts = map[string]time.Duration{http.MethodPost: 2 * time.Minute}
+	t.Cleanup(func() { methodTimeouts = nil })
+
+	r, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if d := requestTimeout(r); d != defaultHTTPTimeout {
+		t.Errorf("expected default timeout, got %s", d)
+	}
+	r, _ = http.NewRequest(http.MethodPost, "http://example.com/", nil)
+	if d := requestTimeout(r); d != 2*time.Minute {
+		t.Errorf("expected method timeout, got %s", d)
+	}
+
+	// transport must not cap per request timeout
+	if d := newTransport(nil).ResponseHeaderTimeout; d != 0 {
+		t.Errorf("expected no transport response header timeout, got %s", d)
+	}
+}
+
+func TestRedirectDropsCredentialsCrossHost(t *testing.T) {
+	var cookie atomic.Value
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie.Store(r.Header.Get("Cookie"))
+	}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:"+port+"/", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	prev := *followRedirects
+	*followRedirects = 1
+	t.Cleanup(func() { *followRedirects = prev })
+
+	client := proxyClient(startProxy(t))
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	req.Header.Set("Cookie", "session=secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected redirect followed, got %d", resp.StatusCode)
+	}
+	if c, _ := cookie.Load().(string); c != "" {
+		t.Errorf("cookie forwarded to other host: %q", c)
+	}
+}
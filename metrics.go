@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+
+	"github.com/moonrhythm/parapet/pkg/prom"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "httpproxy"
+
+var (
+	breakerOpenHosts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_open_hosts",
+		Help:      "Number of hosts with open circuit breaker",
+	})
+	breakerTrips = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_trips_total",
+		Help:      "Number of times circuit breaker opened",
+	})
+	breakerRejects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_rejects_total",
+		Help:      "Number of requests rejected by open circuit breaker",
+	})
+	inflightRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "inflight_requests",
+		Help:      "Number of in-flight requests and tunnels per destination host",
+	}, []string{"host"})
+	inflightRejects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "inflight_rejects_total",
+		Help:      "Number of requests rejected by max in-flight per host",
+	})
+	hijackFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hijack_failures_total",
+		Help:      "Number of CONNECT requests failed to hijack client connection",
+	}, []string{"reason"})
+	forwardProxyDials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "forward_proxy_dials_total",
+		Help:      "Number of connections to parent proxies of -forward-proxy by result",
+	}, []string{"parent", "result"})
+	destinationRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "destination_requests_total",
+		Help:      "Number of requests and tunnels by requested host, effective host after override, and egress",
+	}, []string{"requested_host", "effective_host", "egress"})
+	mirrorDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirror_drops_total",
+		Help:      "Number of mirrored requests dropped by full mirror queue",
+	})
+)
+
+func init() {
+	prom.Registry().MustRegister(
+		breakerOpenHosts,
+		breakerTrips,
+		breakerRejects,
+		inflightRequests,
+		inflightRejects,
+		hijackFailures,
+		mirrorDrops,
+		forwardProxyDials,
+		destinationRequests,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "mirror_queue_length",
+			Help:      "Number of mirrored requests waiting for mirror workers",
+		}, func() float64 { return float64(len(mirrorQueue)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "upstream_connections_total",
+			Help:        "Number of upstream connections used by HTTP requests",
+			ConstLabels: prometheus.Labels{"reused": "false"},
+		}, func() float64 { return float64(stats.UpstreamConnNew.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "upstream_connections_total",
+			Help:        "Number of upstream connections used by HTTP requests",
+			ConstLabels: prometheus.Labels{"reused": "true"},
+		}, func() float64 { return float64(stats.UpstreamConnReused.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_connection_reuse_ratio",
+			Help:      "Ratio of reused upstream connections",
+		}, stats.upstreamConnReuseRatio),
+	)
+}
+
+// countDestination counts request to requested host when -destination-metrics is enabled,
+// effective host is taken from dialed address, requested host when dialed address is empty
+func countDestination(requested, dialAddr, egress string) {
+	if !*destinationMetrics {
+		return
+	}
+	effective := requested
+	if dialAddr != "" {
+		if host, _, err := net.SplitHostPort(dialAddr); err == nil {
+			effective = host
+		}
+	}
+	destinationRequests.WithLabelValues(requested, effective, egress).Inc()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const mirrorTimeout = 10 * time.Second
+
+var (
+	mirrorTarget *url.URL
+	mirrorClient = &http.Client{
+		Timeout: mirrorTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+// mirrorQueue holds captured requests waiting for mirror workers
+var mirrorQueue chan *mirrorRequest
+
+// startMirrorWorkers starts workers sending queued requests to mirror url
+func startMirrorWorkers(workers, queue int) {
+	mirrorQueue = make(chan *mirrorRequest, queue)
+	for range workers {
+		go func() {
+			for req := range mirrorQueue {
+				req.do()
+			}
+		}()
+	}
+}
+
+// mirror captures request to replay to mirror url after request finished
+type mirror struct {
+	method string
+	url    string
+	header http.Header
+	body   *mirrorBody // nil if request has no body
+}
+
+// mirrorRequest is captured request ready to send to mirror url
+type mirrorRequest struct {
+	method string
+	url    string
+	header http.Header
+	body   []byte
+}
+
+// newMirror starts capturing request body,
+// r.Body is replaced to tee body into bounded buffer
+func newMirror(r *http.Request) *mirror {
+	m := mirror{
+		method: r.Method,
+		url:    r.URL.String(),
+		header: r.Header.Clone(),
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		m.body = &mirrorBody{ReadCloser: r.Body, limit: *mirrorMaxBody}
+		r.Body = m.body
+	}
+	return &m
+}
+
+// send queues captured request for mirror workers,
+// request with partial read or oversized body is not mirrored,
+// request is dropped when queue is full
+func (m *mirror) send() {
+	req := mirrorRequest{
+		method: m.method,
+		url:    m.url,
+		header: m.header,
+	}
+	if m.body != nil {
+		var ok bool
+		req.body, ok = m.body.captured()
+		if !ok {
+			return
+		}
+	}
+
+	select {
+	case mirrorQueue <- &req:
+	default:
+		mirrorDrops.Inc()
+	}
+}
+
+func (m *mirrorRequest) do() {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, m.method, mirrorTarget.String(), bytes.NewReader(m.body))
+	if err != nil {
+		return
+	}
+	req.Header = m.header
+	req.Header.Set("X-Mirror-Url", m.url)
+	resp, err := mirrorClient.Do(req)
+	if err != nil {
+		slog.Debug("mirror error", "url", m.url, "error", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// mirrorBody copies body into buffer while upstream reads it,
+// transport may still be reading body when handler returns
+type mirrorBody struct {
+	io.ReadCloser
+	limit int64
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	overflow bool
+	eof      bool
+}
+
+// captured returns captured body, ok is false if body was not fully captured
+func (b *mirrorBody) captured() (body []byte, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.eof || b.overflow {
+		return nil, false
+	}
+	return bytes.Clone(b.buf.Bytes()), true
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
@@ -0,0 +1,48 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peekClosed reports error if peer already closed connection,
+// it peeks socket without blocking so no data is consumed
+func peekClosed(c net.Conn) error {
+	if bc, ok := c.(*bufferedConn); ok && bc.r.Buffered() > 0 {
+		return nil
+	}
+	tc, ok := tcpConn(c)
+	if !ok {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var (
+		n    int
+		perr error
+		buf  [1]byte
+	)
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, perr = unix.Recvfrom(int(fd), buf[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		return true
+	})
+	switch {
+	case err != nil:
+		return err
+	case errors.Is(perr, unix.EAGAIN), errors.Is(perr, unix.EINTR):
+		return nil
+	case perr != nil:
+		return perr
+	case n == 0:
+		return io.EOF
+	}
+	return nil
+}
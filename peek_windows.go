@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+)
+
+// peekClosed returns nil, closed upstream is detected when tunnel starts copying
+func peekClosed(net.Conn) error {
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/healthz"
+)
+
+const (
+	probeTimeout  = 10 * time.Second
+	probeInterval = 5 * time.Second
+)
+
+var (
+	hz       = healthz.New()
+	draining atomic.Bool
+)
+
+// drain fails readiness for load balancer to stop sending new connections
+func drain() {
+	draining.Store(true)
+	hz.SetReady(false)
+}
+
+// probeReadiness keeps probing target until success then reports ready
+func probeReadiness(target *url.URL) {
+	hz.SetReady(false)
+	for {
+		err := probe(target)
+		if err == nil {
+			slog.Info("readiness probe success", "url", target.String())
+			hz.SetReady(!draining.Load())
+			return
+		}
+		slog.Error("readiness probe error", "url", target.String(), "error", err)
+		time.Sleep(probeInterval)
+	}
+}
+
+// probe checks target reachable through egress,
+// http fetches the url, https connects to the host
+func probe(target *url.URL) error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	host := target.Hostname()
+	eg := routeEgress(host)
+
+	switch target.Scheme {
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := eg.Transport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		return nil
+	case "https":
+		port := target.Port()
+		if port == "" {
+			port = "443"
+		}
+		conn, err := eg.Dial(ctx, "tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	default:
+		return fmt.Errorf("unsupported scheme %s", target.Scheme)
+	}
+}
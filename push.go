@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/prom"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushMetricsLoop pushes metrics to Pushgateway every interval,
+// grouped by instance so pushes from different nodes do not collide
+func pushMetricsLoop(url string, interval time.Duration) {
+	instance := *pushgatewayInstance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	pusher := push.New(url, "httpproxy").
+		Gatherer(prom.Registry()).
+		Grouping("instance", instance)
+
+	for {
+		time.Sleep(interval)
+		err := pusher.Push()
+		if err != nil {
+			slog.Error("push metrics error", "error", err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// record and replay http round trips for client testing, not for production
+
+var errNotRecorded = errors.New("response not recorded")
+
+// recording is recorded http round trip
+type recording struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	MatchHeader http.Header `json:"matchHeader,omitempty"`
+	StatusCode  int         `json:"statusCode"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+}
+
+// recordingFile returns file name of request recording,
+// keyed by method, url and -record-headers
+func recordingFile(dir string, r *http.Request) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.String())
+	for _, k := range splitList(*recordHeaders) {
+		io.WriteString(h, "\n"+http.CanonicalHeaderKey(k)+": "+strings.Join(r.Header.Values(k), ","))
+	}
+	return filepath.Join(dir, hex.EncodeToString(h.Sum(nil))+".json")
+}
+
+// replayResponse returns recorded response of request from -replay-dir
+func replayResponse(r *http.Request) (*http.Response, error) {
+	b, err := os.ReadFile(recordingFile(*replayDir, r))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotRecorded
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec recording
+	err = json.Unmarshal(b, &rec)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        http.StatusText(rec.StatusCode),
+		StatusCode:    rec.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Header,
+		Body:          io.NopCloser(bytes.NewReader(rec.Body)),
+		ContentLength: int64(len(rec.Body)),
+		Request:       r,
+	}, nil
+}
+
+// recordResponse saves response to -record-dir when its body is read to the end
+func recordResponse(r *http.Request, resp *http.Response) {
+	rec := &recording{
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+	}
+	for _, k := range splitList(*recordHeaders) {
+		if vs := r.Header.Values(k); len(vs) > 0 {
+			if rec.MatchHeader == nil {
+				rec.MatchHeader = make(http.Header)
+			}
+			rec.MatchHeader[http.CanonicalHeaderKey(k)] = vs
+		}
+	}
+	resp.Body = &recordBody{
+		ReadCloser: resp.Body,
+		file:       recordingFile(*recordDir, r),
+		rec:        rec,
+	}
+}
+
+type recordBody struct {
+	io.ReadCloser
+	file  string
+	rec   *recording
+	buf   bytes.Buffer
+	saved bool
+}
+
+func (b *recordBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF && !b.saved {
+		b.saved = true
+		b.save()
+	}
+	return n, err
+}
+
+func (b *recordBody) save() {
+	b.rec.Body = b.buf.Bytes()
+	data, err := json.MarshalIndent(b.rec, "", "  ")
+	if err != nil {
+		slog.Error("record error", "url", b.rec.URL, "error", err)
+		return
+	}
+
+	// write to temp file then rename, replay never sees partial file
+	tmp := b.file + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, b.file)
+	}
+	if err != nil {
+		slog.Error("record error", "url", b.rec.URL, "error", err)
+		return
+	}
+	slog.Debug("recorded", "method", b.rec.Method, "url", b.rec.URL, "file", b.file)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var statusRewrites map[int]int
+
+// parseStatusRewrites parses from=to list (ex. 451=403,402=403)
+func parseStatusRewrites(s string) (map[int]int, error) {
+	m := make(map[int]int)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid status rewrite %s", p)
+		}
+		fromCode, err := strconv.Atoi(from)
+		if err != nil || fromCode < 100 || fromCode > 999 {
+			return nil, fmt.Errorf("invalid status rewrite %s", p)
+		}
+		toCode, err := strconv.Atoi(to)
+		if err != nil || toCode < 100 || toCode > 999 {
+			return nil, fmt.Errorf("invalid status rewrite %s", p)
+		}
+		m[fromCode] = toCode
+	}
+	return m, nil
+}
+
+// rewriteStatus rewrites upstream response status,
+// returns true if response body was replaced
+func rewriteStatus(resp *http.Response) bool {
+	to, ok := statusRewrites[resp.StatusCode]
+	if !ok {
+		return false
+	}
+	resp.StatusCode = to
+	if *rewriteStatusBody == "" {
+		return false
+	}
+
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Range")
+	resp.Header.Del("Etag")
+	resp.Header.Del("Last-Modified")
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Header.Set("X-Content-Type-Options", "nosniff")
+	return true
+}
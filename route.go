@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type route struct {
+	Hosts  []string
+	Egress *egress
+}
+
+var (
+	egresses     = map[string]*egress{directEgress.Name: directEgress}
+	routes       []route
+	defaultRoute = directEgress
+)
+
+// setupRoutes configs routing table from config
+func setupRoutes(cfg *config) error {
+	for name, c := range cfg.Egress {
+		eg, err := newEgress(name, c)
+		if err != nil {
+			return err
+		}
+		egresses[name] = eg
+	}
+
+	for _, c := range cfg.Routes {
+		eg := egresses[c.Egress]
+		if eg == nil {
+			return fmt.Errorf("route: egress %s not found", c.Egress)
+		}
+		routes = append(routes, route{
+			Hosts:  c.Hosts,
+			Egress: eg,
+		})
+	}
+
+	if cfg.DefaultRoute != "" {
+		defaultRoute = egresses[cfg.DefaultRoute]
+		if defaultRoute == nil {
+			return fmt.Errorf("route: default egress %s not found", cfg.DefaultRoute)
+		}
+	}
+	return nil
+}
+
+// routeEgress returns egress for given host
+func routeEgress(host string) *egress {
+	for _, rt := range routes {
+		if matchHosts(rt.Hosts, host) {
+			return rt.Egress
+		}
+	}
+	return defaultRoute
+}
+
+// selectEgress returns egress for request to given host,
+// exit selected by exit header takes precedence,
+// then authenticated user's egress, tenant's egress and routing table
+func selectEgress(r *http.Request, host string) *egress {
+	if eg := requestExit(r); eg != nil {
+		return eg
+	}
+	eg := routeEgress(host)
+	if t := requestTenant(r); t != nil && t.Egress != nil {
+		eg = t.Egress
+	}
+	if u := requestUser(r); u != nil && u.Egress != nil {
+		eg = u.Egress
+	}
+	if eg == directEgress && len(bindEgresses) > 0 {
+		return stickyEgress(r)
+	}
+	return eg
+}
+
+// hostOverride pins destination hosts to static address
+type hostOverride struct {
+	Host string // host pattern
+	Addr string // host or host:port, port from request when missing
+}
+
+var upstreamOverrides []hostOverride
+
+// parseUpstreamOverrides parses host=addr entries into upstream overrides
+func parseUpstreamOverrides(list []string) error {
+	for _, s := range list {
+		host, addr, ok := strings.Cut(s, "=")
+		if !ok || host == "" || addr == "" {
+			return fmt.Errorf("invalid upstream override %s", s)
+		}
+		upstreamOverrides = append(upstreamOverrides, hostOverride{Host: host, Addr: addr})
+	}
+	return nil
+}
+
+// overrideAddr returns address to dial for destination address
+func overrideAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	for _, o := range upstreamOverrides {
+		if !matchHost(o.Host, host) {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(o.Addr); err == nil {
+			return o.Addr
+		}
+		return net.JoinHostPort(o.Addr, port)
+	}
+	return addr
+}
+
+// urlAddr returns host:port of url, port from scheme when missing
+func urlAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// overrideDial returns dial function that dials overridden address,
+// Host header and TLS server name still use original host
+func overrideDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dial(ctx, network, overrideAddr(addr))
+	}
+}
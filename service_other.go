@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+
+	"github.com/moonrhythm/parapet"
+)
+
+var errServiceNotSupported = errors.New("service is only supported on windows")
+
+func isService() bool {
+	return false
+}
+
+func controlService(string) error {
+	return errServiceNotSupported
+}
+
+func runService(*parapet.Server) error {
+	return errServiceNotSupported
+}
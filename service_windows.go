@@ -0,0 +1,153 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/moonrhythm/parapet"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "httpproxy"
+
+// isService reports whether process is started by service manager
+func isService() bool {
+	ok, _ := svc.IsWindowsService()
+	return ok
+}
+
+// controlService installs or uninstalls windows service
+func controlService(cmd string) error {
+	switch cmd {
+	case "install":
+		return installService()
+	case "uninstall":
+		return uninstallService()
+	default:
+		return fmt.Errorf("unknown service command %s", cmd)
+	}
+}
+
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+
+	s, err = m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "HTTP Proxy",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs(os.Args[1:])...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	slog.Info("service installed", "name", serviceName)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	err = s.Delete()
+	if err != nil {
+		return err
+	}
+
+	slog.Info("service uninstalled", "name", serviceName)
+	return nil
+}
+
+// serviceArgs removes -service flag from args
+func serviceArgs(args []string) []string {
+	var xs []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == "service" {
+			i++ // skip value
+			continue
+		}
+		if strings.HasPrefix(name, "service=") {
+			continue
+		}
+		xs = append(xs, args[i])
+	}
+	return xs
+}
+
+// runService runs server under windows service manager
+func runService(srv *parapet.Server) error {
+	return svc.Run(serviceName, &service{srv: srv})
+}
+
+type service struct {
+	srv *parapet.Server
+}
+
+func (s *service) Execute(_ []string, req <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+
+	status <- svc.Status{State: svc.StartPending}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.srv.ListenAndServe()
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	for {
+		select {
+		case err := <-errc:
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("start server error", "error", err)
+				return false, 1
+			}
+			return false, 0
+		case c := <-req:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				// requests and tunnels each get the grace period
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(2 * shutdownTimeout.Milliseconds())}
+				err := s.srv.Shutdown()
+				if err != nil {
+					slog.Error("shutdown server error", "error", err)
+				}
+				tunnels.Shutdown(*shutdownTimeout)
+				return false, 0
+			}
+		}
+	}
+}
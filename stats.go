@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log/slog"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// counters are process wide counters, safe for concurrent use
+type counters struct {
+	Requests     atomic.Int64 // proxied http requests
+	Tunnels      atomic.Int64 // established tunnels
+	PeakTunnels  atomic.Int64 // maximum concurrent tunnels
+	BytesIn      atomic.Int64 // bytes received from clients
+	BytesOut     atomic.Int64 // bytes sent to clients
+	Errors       atomic.Int64 // proxy generated error responses
+	AuthFailures atomic.Int64
+
+	UpstreamConnNew    atomic.Int64
+	UpstreamConnReused atomic.Int64
+}
+
+var stats counters
+
+var startTime = time.Now()
+
+// logSummary logs totals of the run, called before exit
+func logSummary() {
+	slog.Info("summary",
+		"uptime", time.Since(startTime).Round(time.Second),
+		"requests", stats.Requests.Load(),
+		"tunnels", stats.Tunnels.Load(),
+		"peak_tunnels", stats.PeakTunnels.Load(),
+		"bytes_in", stats.BytesIn.Load(),
+		"bytes_out", stats.BytesOut.Load(),
+		"errors", stats.Errors.Load(),
+	)
+}
+
+// upstreamConnReuseRatio returns ratio of reused upstream connections
+func (c *counters) upstreamConnReuseRatio() float64 {
+	reused := c.UpstreamConnReused.Load()
+	total := c.UpstreamConnNew.Load() + reused
+	if total == 0 {
+		return 0
+	}
+	return float64(reused) / float64(total)
+}
+
+var connTrace = &httptrace.ClientTrace{
+	GotConn: func(info httptrace.GotConnInfo) {
+		if info.Reused {
+			stats.UpstreamConnReused.Add(1)
+		} else {
+			stats.UpstreamConnNew.Add(1)
+		}
+	},
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCountersConcurrent hammers counters from concurrent requests and tunnels
+// while reading stats, run with -race
+func TestCountersConcurrent(t *testing.T) {
+	const (
+		workers  = 20
+		requests = 25
+		payload  = 1000
+	)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	target := startTCPUpstream(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	proxyURL := startProxy(t)
+	client := proxyClient(proxyURL)
+
+	requestsBefore, tunnelsBefore := stats.Requests.Load(), stats.Tunnels.Load()
+	bytesInBefore, bytesOutBefore := stats.BytesIn.Load(), stats.BytesOut.Load()
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				adminStats(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stats", nil))
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range requests {
+				resp, err := client.Get(upstream.URL)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+
+			code, conn := dialTunnel(t, proxyURL, target)
+			if code != http.StatusOK {
+				t.Errorf("expected 200, got %d", code)
+				return
+			}
+			io.WriteString(conn, strings.Repeat("x", payload))
+			conn.(*net.TCPConn).CloseWrite()
+			io.Copy(io.Discard, conn)
+		}()
+	}
+	wg.Wait()
+
+	// counters are updated when handlers return
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tunnels.List()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+
+	if n := stats.Requests.Load() - requestsBefore; n != workers*requests {
+		t.Errorf("requests: expected %d, got %d", workers*requests, n)
+	}
+	if n := stats.Tunnels.Load() - tunnelsBefore; n != workers {
+		t.Errorf("tunnels: expected %d, got %d", workers, n)
+	}
+	if n := stats.BytesIn.Load() - bytesInBefore; n != workers*payload {
+		t.Errorf("bytes in: expected %d, got %d", workers*payload, n)
+	}
+	if n := stats.BytesOut.Load() - bytesOutBefore; n != workers*requests*int64(len("hello")) {
+		t.Errorf("bytes out: expected %d, got %d", workers*requests*len("hello"), n)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const tarpitInterval = time.Second
+
+var tarpitSlots chan struct{}
+
+// tarpit holds denied request open while drip-feeding 403 response,
+// returns false when tarpit is disabled or all slots are in use
+func tarpit(w http.ResponseWriter, r *http.Request) bool {
+	if *tarpitDuration <= 0 {
+		return false
+	}
+
+	select {
+	case tarpitSlots <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-tarpitSlots }()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	rc.Flush()
+
+	deadline := time.NewTimer(*tarpitDuration)
+	defer deadline.Stop()
+	ticker := time.NewTicker(tarpitInterval)
+	defer ticker.Stop()
+
+	const msg = "Forbidden\n"
+	for i := 0; ; i++ {
+		select {
+		case <-r.Context().Done():
+			return true
+		case <-deadline.C:
+			return true
+		case <-ticker.C:
+			if _, err := w.Write([]byte{msg[i%len(msg)]}); err != nil {
+				return true
+			}
+			rc.Flush()
+		}
+	}
+}
+
+// forbidden responds to request denied by acl, tarpitted when enabled
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	if tarpit(w, r) {
+		return
+	}
+	proxyError(w, r, "Forbidden", http.StatusForbidden)
+}
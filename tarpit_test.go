@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTarpitACLDenied(t *testing.T) {
+	*tarpitDuration = 50 * time.Millisecond
+	tarpitSlots = make(chan struct{}, 1)
+	denyHosts = []string{"example.com"}
+	t.Cleanup(func() {
+		*tarpitDuration = 0
+		denyHosts = nil
+	})
+
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		req     *http.Request
+	}{
+		{"connect", handleTunnel, httptest.NewRequest(http.MethodConnect, "example.com:443", nil)},
+		{"http", handleHTTP, httptest.NewRequest(http.MethodGet, "http://example.com/", nil)},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		c.handler(w, c.req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", c.name, w.Code)
+		}
+		if time.Since(start) < *tarpitDuration {
+			t.Errorf("%s: expected denied request to be tarpitted", c.name)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync/atomic"
+
+	"github.com/moonrhythm/parapet"
+)
+
+// tenant is a named profile of egress and limits selected per request
+type tenant struct {
+	Name        string
+	Egress      *egress  // nil to use routing table
+	AllowHosts  []string // empty to allow all hosts
+	MaxInflight int      // concurrent requests and tunnels, 0 for unlimited
+	Users       []string // identities allowed to select tenant by header
+
+	inflight atomic.Int64
+}
+
+var (
+	tenants       = make(map[string]*tenant)
+	defaultTenant *tenant // profile for unknown tenants, nil for none
+)
+
+// setupTenants adds tenants from config
+func setupTenants(cfg *config) error {
+	for name, c := range cfg.Tenants {
+		t := tenant{
+			Name:        name,
+			AllowHosts:  c.AllowHosts,
+			MaxInflight: c.MaxInflight,
+			Users:       c.Users,
+		}
+		if c.Egress != "" {
+			t.Egress = egresses[c.Egress]
+			if t.Egress == nil {
+				return fmt.Errorf("tenant %s: egress %s not found", name, c.Egress)
+			}
+		}
+		tenants[name] = &t
+	}
+
+	if cfg.DefaultTenant != "" {
+		defaultTenant = tenants[cfg.DefaultTenant]
+		if defaultTenant == nil {
+			return fmt.Errorf("tenant: default tenant %s not found", cfg.DefaultTenant)
+		}
+	}
+	switch *tenantKey {
+	case "header", "user":
+	default:
+		return fmt.Errorf("invalid tenant key %s", *tenantKey)
+	}
+	return nil
+}
+
+type tenantKeyCtx struct{}
+
+// selectTenant returns middleware that selects tenant of request by -tenant-key,
+// tenant header is always removed from request.
+// With auth configured, tenant header is accepted only from users of the tenant,
+// and request without header uses tenant of its user so tenant limits can not be dodged
+func selectTenant(authRequired bool) parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(*tenantHeader)
+			r.Header.Del(*tenantHeader)
+
+			var t *tenant
+			switch {
+			case *tenantKey == "user":
+				t = tenants[identity(r)]
+			case key != "":
+				t = tenants[key]
+				if t == nil || (authRequired && !t.hasUser(identity(r))) {
+					audit(r, key, "tenant", false)
+					proxyError(w, r, "Forbidden", http.StatusForbidden)
+					return
+				}
+			case authRequired:
+				ts := userTenants(identity(r))
+				if len(ts) > 1 {
+					proxyError(w, r, "Tenant Required", http.StatusForbidden)
+					return
+				}
+				if len(ts) == 1 {
+					t = ts[0]
+				}
+			}
+			if t == nil {
+				t = defaultTenant
+			}
+			if t == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			n := t.inflight.Add(1)
+			defer t.inflight.Add(-1)
+			if t.MaxInflight > 0 && n > int64(t.MaxInflight) {
+				proxyError(w, r, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKeyCtx{}, t)))
+		})
+	})
+}
+
+// hasUser reports whether identity is user of tenant
+func (t *tenant) hasUser(id string) bool {
+	return id != "" && slices.Contains(t.Users, id)
+}
+
+// userTenants returns tenants that identity is user of
+func userTenants(id string) []*tenant {
+	var ts []*tenant
+	for _, t := range tenants {
+		if t.hasUser(id) {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// requestTenant returns tenant of request, nil if none
+func requestTenant(r *http.Request) *tenant {
+	t, _ := r.Context().Value(tenantKeyCtx{}).(*tenant)
+	return t
+}
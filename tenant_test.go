@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSelectTenantWithAuth(t *testing.T) {
+	tenants = map[string]*tenant{
+		"acme":   {Name: "acme", Users: []string{"alice", "carol"}},
+		"globex": {Name: "globex", Users: []string{"bob", "carol"}},
+		"shared": {Name: "shared"},
+	}
+	defaultTenant = tenants["shared"]
+	t.Cleanup(func() {
+		tenants = make(map[string]*tenant)
+		defaultTenant = nil
+	})
+
+	var got *tenant
+	h := selectTenant(true).ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestTenant(r)
+	}))
+
+	cases := []struct {
+		user   string
+		header string
+		code   int
+		tenant string
+	}{
+		{user: "alice", header: "acme", code: http.StatusOK, tenant: "acme"},
+		{user: "alice", code: http.StatusOK, tenant: "acme"},
+		{user: "alice", header: "globex", code: http.StatusForbidden},
+		{user: "alice", header: "unknown", code: http.StatusForbidden},
+		{user: "carol", code: http.StatusForbidden},
+		{user: "carol", header: "globex", code: http.StatusOK, tenant: "globex"},
+		{user: "dave", code: http.StatusOK, tenant: "shared"},
+		{header: "acme", code: http.StatusForbidden},
+	}
+	for _, c := range cases {
+		got = nil
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if c.header != "" {
+			r.Header.Set(*tenantHeader, c.header)
+		}
+		if c.user != "" {
+			r = r.WithContext(context.WithValue(r.Context(), identityKey{}, c.user))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s %q: expected %d, got %d", c.user, c.header, c.code, w.Code)
+			continue
+		}
+		if c.tenant != "" && (got == nil || got.Name != c.tenant) {
+			t.Errorf("%s %q: expected tenant %s, got %v", c.user, c.header, c.tenant, got)
+		}
+	}
+}
+
+func TestSelectTenantUnknownHeader(t *testing.T) {
+	tenants = map[string]*tenant{"acme": {Name: "acme"}}
+	t.Cleanup(func() { tenants = make(map[string]*tenant) })
+
+	h := selectTenant(false).ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set(*tenantHeader, "unknown")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected unknown tenant forbidden, got %d", w.Code)
+	}
+}
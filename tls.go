@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/moonrhythm/parapet"
+)
+
+// setupTLS serves proxy over TLS,
+// ClientHello of each connection is captured for fingerprint logging
+func setupTLS(srv *parapet.Server) error {
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return err
+	}
+	minVersion, err := parseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return err
+	}
+	ciphers, err := parseTLSCiphers(splitList(*tlsCiphers))
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		CipherSuites: ciphers,
+	}
+	if sniAllow := splitList(*proxySNIAllow); len(sniAllow) > 0 {
+		srv.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if hello.ServerName == "" || !matchHosts(sniAllow, hello.ServerName) {
+				return nil, fmt.Errorf("server name %q not allowed", hello.ServerName)
+			}
+			return nil, nil // use base config
+		}
+	}
+	modifyConnection(srv, func(conn net.Conn) net.Conn {
+		addr := conn.RemoteAddr().String()
+		return &helloSniffConn{
+			Conn: conn,
+			onDone: func(hello clientHello, ok bool) {
+				if ok {
+					listenerHellos.Set(addr, &hello)
+				}
+			},
+		}
+	})
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed || state == http.StateHijacked {
+			listenerHellos.Remove(conn.RemoteAddr().String())
+		}
+	}
+	return nil
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid tls version %s", s)
+}
+
+// parseTLSCiphers parses cipher suite names, nil to use default.
+// Cipher suites only apply to TLS 1.2 and below.
+func parseTLSCiphers(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	m := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		m[c.Name] = c.ID
+	}
+	for _, c := range tls.InsecureCipherSuites() {
+		m[c.Name] = c.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := m[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls cipher %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// helloRegistry stores ClientHello of listener connections by remote address
+type helloRegistry struct {
+	mu sync.RWMutex
+	m  map[string]*clientHello
+}
+
+var listenerHellos = helloRegistry{m: make(map[string]*clientHello)}
+
+func (h *helloRegistry) Set(addr string, hello *clientHello) {
+	h.mu.Lock()
+	h.m[addr] = hello
+	h.mu.Unlock()
+}
+
+func (h *helloRegistry) Get(addr string) *clientHello {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.m[addr]
+}
+
+func (h *helloRegistry) Remove(addr string) {
+	h.mu.Lock()
+	delete(h.m, addr)
+	h.mu.Unlock()
+}
+
+// requestJA3 returns JA3 hash of client connection, empty if not TLS
+func requestJA3(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	hello := listenerHellos.Get(r.RemoteAddr)
+	if hello == nil {
+		return ""
+	}
+	return hello.JA3Hash()
+}
+
+// tlsLogArgs returns negotiated TLS version and ALPN of client connection for logging,
+// nil if not TLS
+func tlsLogArgs(r *http.Request) []any {
+	if r.TLS == nil {
+		return nil
+	}
+	return []any{
+		"tls_version", tls.VersionName(r.TLS.Version),
+		"alpn", r.TLS.NegotiatedProtocol,
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const maxHelloSize = 5 + 16384 // record header + max record size
+
+// clientHello is parsed TLS ClientHello
+type clientHello struct {
+	ServerName string
+	ALPN       []string
+
+	// fields for JA3, GREASE values are excluded
+	Version      uint16
+	Ciphers      []uint16
+	Extensions   []uint16
+	Curves       []uint16
+	PointFormats []uint8
+}
+
+// parseClientHello parses first TLS record,
+// returns ok false when data is not ClientHello
+func parseClientHello(b []byte) (hello clientHello, ok bool) {
+	// record header
+	if len(b) < 5 || b[0] != 0x16 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(b[3:5]))
+	if len(b) < 5+n {
+		return
+	}
+	b = b[5 : 5+n]
+
+	// handshake header
+	if len(b) < 4 || b[0] != 0x01 {
+		return
+	}
+	n = int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	if len(b) < 4+n {
+		return
+	}
+	p := parser(b[4 : 4+n])
+
+	hello.Version = p.u16()
+	p.skip(32)          // random
+	p.skip(int(p.u8())) // session id
+	ciphers := parser(p.bytes(int(p.u16())))
+	for len(ciphers) >= 2 {
+		if c := ciphers.u16(); !isGREASE(c) {
+			hello.Ciphers = append(hello.Ciphers, c)
+		}
+	}
+	p.skip(int(p.u8())) // compression methods
+
+	exts := parser(p.bytes(int(p.u16())))
+	for len(exts) >= 4 {
+		typ := exts.u16()
+		data := parser(exts.bytes(int(exts.u16())))
+		if isGREASE(typ) {
+			continue
+		}
+		hello.Extensions = append(hello.Extensions, typ)
+
+		switch typ {
+		case 0: // server_name
+			list := parser(data.bytes(int(data.u16())))
+			for len(list) >= 3 {
+				nameType := list.u8()
+				name := list.bytes(int(list.u16()))
+				if nameType == 0 {
+					hello.ServerName = string(name)
+				}
+			}
+		case 16: // application_layer_protocol_negotiation
+			list := parser(data.bytes(int(data.u16())))
+			for len(list) > 0 {
+				proto := list.bytes(int(list.u8()))
+				if len(proto) > 0 {
+					hello.ALPN = append(hello.ALPN, string(proto))
+				}
+			}
+		case 10: // supported_groups
+			list := parser(data.bytes(int(data.u16())))
+			for len(list) >= 2 {
+				if c := list.u16(); !isGREASE(c) {
+					hello.Curves = append(hello.Curves, c)
+				}
+			}
+		case 11: // ec_point_formats
+			hello.PointFormats = append(hello.PointFormats, data.bytes(int(data.u8()))...)
+		}
+	}
+	return hello, true
+}
+
+// isGREASE reports whether v is reserved GREASE value (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// JA3 returns JA3 fingerprint string of ClientHello
+func (h *clientHello) JA3() string {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(h.Version)))
+	b.WriteByte(',')
+	writeJA3List(&b, h.Ciphers)
+	b.WriteByte(',')
+	writeJA3List(&b, h.Extensions)
+	b.WriteByte(',')
+	writeJA3List(&b, h.Curves)
+	b.WriteByte(',')
+	writeJA3List(&b, h.PointFormats)
+	return b.String()
+}
+
+// JA3Hash returns md5 hex of JA3 fingerprint string
+func (h *clientHello) JA3Hash() string {
+	sum := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeJA3List[T uint8 | uint16](b *strings.Builder, list []T) {
+	for i, x := range list {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(x)))
+	}
+}
+
+// parser reads big-endian values, returns zero values when out of data
+type parser []byte
+
+func (p *parser) skip(n int) {
+	if n > len(*p) {
+		n = len(*p)
+	}
+	*p = (*p)[n:]
+}
+
+func (p *parser) bytes(n int) []byte {
+	if n > len(*p) {
+		n = len(*p)
+	}
+	b := (*p)[:n]
+	*p = (*p)[n:]
+	return b
+}
+
+func (p *parser) u8() uint8 {
+	b := p.bytes(1)
+	if len(b) < 1 {
+		return 0
+	}
+	return b[0]
+}
+
+func (p *parser) u16() uint16 {
+	b := p.bytes(2)
+	if len(b) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// helloSniffConn captures first bytes read from client to parse ClientHello,
+// data still flows through unchanged
+type helloSniffConn struct {
+	net.Conn
+	buf    []byte
+	done   bool
+	onDone func(hello clientHello, ok bool)
+}
+
+func (c *helloSniffConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.done && n > 0 {
+		c.buf = append(c.buf, p[:n]...)
+		c.sniff()
+	}
+	return n, err
+}
+
+func (c *helloSniffConn) sniff() {
+	if len(c.buf) < 5 {
+		return
+	}
+	if c.buf[0] != 0x16 {
+		c.finish(clientHello{}, false)
+		return
+	}
+	size := 5 + int(binary.BigEndian.Uint16(c.buf[3:5]))
+	if size > maxHelloSize {
+		c.finish(clientHello{}, false)
+		return
+	}
+	if len(c.buf) < size {
+		return
+	}
+	c.finish(parseClientHello(c.buf))
+}
+
+func (c *helloSniffConn) finish(hello clientHello, ok bool) {
+	c.done = true
+	c.buf = nil
+	c.onDone(hello, ok)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+var trustedForwarders []*net.IPNet
+
+// transparentTarget sets request url to destination from Host header,
+// or SNI when Host header is missing on intercepted TLS connection.
+// It reports false when destination is invalid or points to proxy itself.
+func transparentTarget(r *http.Request) bool {
+	scheme, port := "http", "80"
+	if r.TLS != nil {
+		scheme, port = "https", "443"
+	}
+
+	host := r.Host
+	if fh := forwardedHost(r); fh != "" {
+		host = fh
+	}
+	if host == "" && r.TLS != nil {
+		host = r.TLS.ServerName
+	}
+	hostname, p, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	} else {
+		port = p
+	}
+	if !validHostname(hostname) {
+		return false
+	}
+	addr := net.JoinHostPort(hostname, port)
+
+	// request sent to proxy address without redirect, would loop back to proxy
+	if la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && la.String() == addr {
+		return false
+	}
+
+	r.URL.Scheme = scheme
+	r.URL.Host = addr
+	r.Host = host
+	return true
+}
+
+// forwardedHost returns destination host from RFC 7239 Forwarded header,
+// only when request comes from trusted forwarder.
+// The last element is used, it is added by the closest forwarder.
+func forwardedHost(r *http.Request) string {
+	if len(trustedForwarders) == 0 || !containsIP(trustedForwarders, net.ParseIP(clientIP(r))) {
+		return ""
+	}
+
+	values := r.Header.Values("Forwarded")
+	if len(values) == 0 {
+		return ""
+	}
+	elems := strings.Split(values[len(values)-1], ",")
+	for _, pair := range strings.Split(elems[len(elems)-1], ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if !strings.EqualFold(k, "host") {
+			continue
+		}
+		v = strings.Trim(v, `"`)
+		hostname, _, err := net.SplitHostPort(v)
+		if err != nil {
+			hostname = v
+		}
+		if !validHostname(hostname) {
+			return ""
+		}
+		return v
+	}
+	return ""
+}
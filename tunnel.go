@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// tunnel is an active CONNECT tunnel
+type tunnel struct {
+	ID       uint64
+	ClientIP string
+	Target   string
+	Egress   string
+	Start    time.Time
+	BytesIn  atomic.Int64 // client to upstream
+	BytesOut atomic.Int64 // upstream to client
+
+	upstream net.Conn
+	client   net.Conn
+}
+
+// Close closes both sides of tunnel
+func (t *tunnel) Close() {
+	t.upstream.Close()
+	t.client.Close()
+}
+
+type tunnelRegistry struct {
+	mu     sync.Mutex
+	lastID uint64
+	m      map[uint64]*tunnel
+	slots  int // CONNECT requests holding slot of -max-tunnels, including tunnels being established
+}
+
+var tunnels = tunnelRegistry{
+	m: make(map[uint64]*tunnel),
+}
+
+func (reg *tunnelRegistry) Add(t *tunnel) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.lastID++
+	t.ID = reg.lastID
+	reg.m[t.ID] = t
+	if n := int64(len(reg.m)); n > stats.PeakTunnels.Load() {
+		stats.PeakTunnels.Store(n)
+	}
+}
+
+// Acquire takes tunnel slot, reports false if -max-tunnels is reached
+func (reg *tunnelRegistry) Acquire() bool {
+	if *maxTunnels <= 0 {
+		return true
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if reg.slots >= *maxTunnels {
+		return false
+	}
+	reg.slots++
+	return true
+}
+
+// Release returns slot taken by Acquire
+func (reg *tunnelRegistry) Release() {
+	if *maxTunnels <= 0 {
+		return
+	}
+
+	reg.mu.Lock()
+	reg.slots--
+	reg.mu.Unlock()
+}
+
+func (reg *tunnelRegistry) Remove(t *tunnel) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	delete(reg.m, t.ID)
+}
+
+func (reg *tunnelRegistry) Get(id uint64) *tunnel {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	return reg.m[id]
+}
+
+// Len returns number of active tunnels
+func (reg *tunnelRegistry) Len() int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	return len(reg.m)
+}
+
+// Shutdown waits for active tunnels to finish until grace period then closes the rest,
+// http server shutdown neither waits for nor closes hijacked connections
+func (reg *tunnelRegistry) Shutdown(grace time.Duration) {
+	deadline := time.Now().Add(grace)
+	for reg.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	xs := reg.List()
+	if len(xs) == 0 {
+		return
+	}
+	slog.Info("close tunnels after shutdown grace period", "tunnels", len(xs))
+	for _, t := range xs {
+		t.Close()
+	}
+
+	// let handlers finish logging closed tunnels
+	for i := 0; reg.Len() > 0 && i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// List returns active tunnels ordered by id
+func (reg *tunnelRegistry) List() []*tunnel {
+	reg.mu.Lock()
+	xs := make([]*tunnel, 0, len(reg.m))
+	for _, t := range reg.m {
+		xs = append(xs, t)
+	}
+	reg.mu.Unlock()
+
+	sort.Slice(xs, func(i, j int) bool { return xs[i].ID < xs[j].ID })
+	return xs
+}
+
+// countWriter counts bytes written into n
+type countWriter struct {
+	w   io.Writer
+	n   *atomic.Int64
+	err error // last write error
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n.Add(int64(n))
+	w.err = err
+	return n, err
+}
+
+// copyEnd reports how one direction of tunnel finished
+type copyEnd struct {
+	Side string // side that ended the copy, client or upstream
+	Err  error  // nil on EOF
+}
+
+// newCopyEnd returns copyEnd of copy from src side to dst side,
+// write error is blamed on dst side, read error and EOF on src side
+func newCopyEnd(src, dst string, w *countWriter, err error) *copyEnd {
+	if err != nil && w.err != nil {
+		return &copyEnd{Side: dst, Err: err}
+	}
+	return &copyEnd{Side: src, Err: err}
+}
+
+func (e *copyEnd) Error() string {
+	return e.Reason()
+}
+
+func (e *copyEnd) Unwrap() error {
+	return e.Err
+}
+
+// Reason returns short close reason for logging
+func (e *copyEnd) Reason() string {
+	switch {
+	case e.Err == nil, errors.Is(e.Err, errHalfClosed):
+		return e.Side + "_eof"
+	case errors.Is(e.Err, os.ErrDeadlineExceeded):
+		return e.Side + "_timeout"
+	case errors.Is(e.Err, syscall.ECONNRESET):
+		return e.Side + "_reset"
+	default:
+		return e.Side + "_error"
+	}
+}
+
+// tcpConn returns underlying tcp connection
+func tcpConn(c net.Conn) (*net.TCPConn, bool) {
+	if bc, ok := c.(*bufferedConn); ok {
+		c = bc.Conn
+	}
+	tc, ok := c.(*net.TCPConn)
+	return tc, ok
+}
+
+// errHalfClosed reports tunnel direction finished with write side of destination closed
+var errHalfClosed = errors.New("half closed")
+
+// closeWrite shuts down writing side of connection,
+// it reports false if connection does not support half-close
+func closeWrite(c net.Conn) bool {
+	if bc, ok := c.(*bufferedConn); ok {
+		c = bc.Conn
+	}
+	cw, ok := c.(interface{ CloseWrite() error })
+	return ok && cw.CloseWrite() == nil
+}
+
+// tuneConn sets socket options for tunnel connection
+func tuneConn(c net.Conn) {
+	tc, ok := tcpConn(c)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(*tcpNoDelay)
+	if *soSndBuf > 0 {
+		tc.SetWriteBuffer(*soSndBuf)
+	}
+	if *soRcvBuf > 0 {
+		tc.SetReadBuffer(*soRcvBuf)
+	}
+	if *tunnelKeepAlive > 0 {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(*tunnelKeepAlive)
+	}
+}
+
+// firstByteConn fails read if upstream sends nothing within timeout
+type firstByteConn struct {
+	net.Conn
+	received atomic.Bool
+}
+
+func newFirstByteConn(c net.Conn, timeout time.Duration) *firstByteConn {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	return &firstByteConn{Conn: c}
+}
+
+func (c *firstByteConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.received.Load() {
+		c.received.Store(true)
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
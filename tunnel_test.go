@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTunnelRegistryShutdownClosesTunnels(t *testing.T) {
+	reg := tunnelRegistry{m: make(map[uint64]*tunnel)}
+
+	client, clientPeer := net.Pipe()
+	upstream, upstreamPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer upstreamPeer.Close()
+
+	tn := &tunnel{client: client, upstream: upstream}
+	reg.Add(tn)
+	go func() {
+		// handler removes tunnel once splice ends
+		client.Read(make([]byte, 1))
+		reg.Remove(tn)
+	}()
+
+	start := time.Now()
+	reg.Shutdown(200 * time.Millisecond)
+	if time.Since(start) < 200*time.Millisecond {
+		t.Error("expected tunnels to be given grace period")
+	}
+	if reg.Len() != 0 {
+		t.Fatal("expected tunnels closed after grace period")
+	}
+	if _, err := upstreamPeer.Write([]byte("x")); err == nil {
+		t.Error("expected upstream closed")
+	}
+}